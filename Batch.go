@@ -0,0 +1,311 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// UpdateBatch sets new values for a set of keys in the tree, and sets and returns the new root of the tree.
+// A DefaultVal value deletes the key, and if a key is given several times its last value is used.
+// The result is the same as calling Update for every key, but each affected node is hashed and
+// written once, and nodes that a later key would overwrite are never written.
+func (smt *SparseMerkleTree) UpdateBatch(keys, values [][]byte) ([]byte, error) {
+	newRoot, err := smt.RootUpdateBatch(keys, values, smt.Root())
+	if err != nil {
+		return nil, err
+	}
+	if err := smt.moveRoot(newRoot); err != nil {
+		return nil, err
+	}
+	return newRoot, nil
+}
+
+// RootUpdateBatch sets new values for a set of keys in the tree at a specific root, and returns the new root.
+func (smt *SparseMerkleTree) RootUpdateBatch(keys, values [][]byte, root []byte) ([]byte, error) {
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+	if len(keys) != len(values) {
+		return nil, errors.New("number of keys and values differ")
+	}
+
+	entries := make([]batchEntry, 0, len(keys))
+	for i, key := range keys {
+		path, err := smt.st.path(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := smt.checkCollision(path, key); err != nil {
+			return nil, err
+		}
+		entry := batchEntry{key: key, path: path, value: values[i]}
+		if !entry.isDelete() {
+			entry.valueHash = smt.st.digest(entry.value)
+		}
+		entries = append(entries, entry)
+	}
+	entries, err := sortEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	b := batchUpdate{smt: smt, created: make(map[string]bool)}
+	newRoot, err := b.update(root, 0, entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.apply(); err != nil {
+		return nil, err
+	}
+	return newRoot, nil
+}
+
+// batchEntry is a change to the value of a path.
+type batchEntry struct {
+	key       []byte
+	path      []byte
+	value     []byte
+	valueHash []byte
+	leafHash  []byte
+}
+
+func (e *batchEntry) isDelete() bool {
+	return bytes.Equal(e.value, DefaultVal)
+}
+
+// sortEntries sorts entries by path in place, keeping the last value given for a path. Different
+// keys with the same path are a KeyCollision.
+func sortEntries(entries []batchEntry) ([]batchEntry, error) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].path, entries[j].path) < 0
+	})
+	unique := entries[:0]
+	for _, entry := range entries {
+		if len(unique) > 0 && bytes.Equal(unique[len(unique)-1].path, entry.path) {
+			if last := unique[len(unique)-1]; !bytes.Equal(last.key, entry.key) {
+				return nil, &KeyCollision{Key: entry.key, Other: last.key}
+			}
+			unique[len(unique)-1] = entry
+			continue
+		}
+		unique = append(unique, entry)
+	}
+	return unique, nil
+}
+
+// batchLeaf is a leaf of a subtree being rebuilt by a batch update.
+type batchLeaf struct {
+	path []byte
+	hash []byte
+	data []byte // data is nil if the leaf is already stored.
+}
+
+// batchUpdate collects the changes of a batch update, so that they are written once it has been computed.
+type batchUpdate struct {
+	smt           *SparseMerkleTree
+	newNodes      [][2][]byte
+	created       map[string]bool // created tells whether each new node is a leaf.
+	orphans       [][]byte
+	orphanLeaves  [][]byte
+	setValues     []batchEntry
+	deletedValues [][]byte
+}
+
+// update applies the entries to the subtree rooted at nodeHash at the given depth, and returns the new root of the subtree.
+func (b *batchUpdate) update(nodeHash []byte, depth int, entries []batchEntry) ([]byte, error) {
+	st := &b.smt.st
+	if len(entries) == 0 {
+		return nodeHash, nil
+	}
+
+	if bytes.Equal(nodeHash, st.EmptyPlace()) {
+		// The entries are the only leaves of the subtree.
+		var leaves []batchLeaf
+		for _, entry := range entries {
+			if !entry.isDelete() {
+				leaves = append(leaves, b.newLeaf(entry))
+			}
+		}
+		return b.build(leaves, depth)
+	}
+
+	nodeData, err := b.smt.nodes.Get(nodeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.isLeaf(nodeData) {
+		// The subtree is made of this leaf and of the entries. The leaf is
+		// replaced if one of the entries has its path and a different value.
+		actualPath, valueHash := st.parseLeaf(nodeData)
+		oldLeaf := &batchLeaf{path: actualPath, hash: nodeHash}
+		var leaves []batchLeaf
+		for _, entry := range entries {
+			if bytes.Equal(entry.path, actualPath) {
+				if !entry.isDelete() && bytes.Equal(entry.valueHash, valueHash) {
+					// The same value is being set.
+					continue
+				}
+				oldLeaf = nil
+				b.orphanLeaves = append(b.orphanLeaves, nodeHash)
+				if entry.isDelete() {
+					b.deletedValues = append(b.deletedValues, entry.path)
+				}
+			}
+			if !entry.isDelete() {
+				leaves = append(leaves, b.newLeaf(entry))
+			}
+		}
+		if oldLeaf != nil {
+			leaves = append(leaves, *oldLeaf)
+			sort.Slice(leaves, func(i, j int) bool {
+				return bytes.Compare(leaves[i].path, leaves[j].path) < 0
+			})
+		}
+		return b.build(leaves, depth)
+	}
+	if depth >= b.smt.depth() {
+		return nil, errors.New("node is deeper than the tree")
+	}
+
+	leftNode, rightNode := st.parseNode(nodeData)
+	leftEntries, rightEntries := splitBatchEntries(entries, depth)
+	newLeft, err := b.update(leftNode, depth+1, leftEntries)
+	if err != nil {
+		return nil, err
+	}
+	newRight, err := b.update(rightNode, depth+1, rightEntries)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(newLeft, leftNode) && bytes.Equal(newRight, rightNode) {
+		return nodeHash, nil
+	}
+
+	b.orphans = append(b.orphans, nodeHash)
+	return b.join(newLeft, newRight)
+}
+
+// newLeaf creates the leaf of an entry that sets a value.
+func (b *batchUpdate) newLeaf(entry batchEntry) batchLeaf {
+	leafHash, leafData := b.smt.st.digestLeaf(entry.path, entry.valueHash)
+	entry.leafHash = leafHash
+	b.setValues = append(b.setValues, entry)
+	return batchLeaf{path: entry.path, hash: leafHash, data: leafData}
+}
+
+// build creates the subtree at the given depth that holds the given leaves, sorted by path, and returns its root.
+func (b *batchUpdate) build(leaves []batchLeaf, depth int) ([]byte, error) {
+	switch len(leaves) {
+	case 0:
+		return b.smt.st.EmptyPlace(), nil
+	case 1:
+		if leaves[0].data != nil {
+			b.newNodes = append(b.newNodes, [2][]byte{leaves[0].hash, leaves[0].data})
+			b.created[string(leaves[0].hash)] = true
+		}
+		return leaves[0].hash, nil
+	}
+
+	split := sort.Search(len(leaves), func(i int) bool {
+		return getBitFromMSB(leaves[i].path, depth) == right
+	})
+	leftHash, err := b.build(leaves[:split], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	rightHash, err := b.build(leaves[split:], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return b.join(leftHash, rightHash)
+}
+
+// join creates the node with the given children, and returns its hash.
+// A leaf whose sibling is a EmptyPlace is bubbled up in place of the node, as DeleteNode does.
+func (b *batchUpdate) join(leftHash, rightHash []byte) ([]byte, error) {
+	st := &b.smt.st
+	leftIsEmpty := bytes.Equal(leftHash, st.EmptyPlace())
+	rightIsEmpty := bytes.Equal(rightHash, st.EmptyPlace())
+	if leftIsEmpty && rightIsEmpty {
+		return st.EmptyPlace(), nil
+	}
+	if leftIsEmpty || rightIsEmpty {
+		child := leftHash
+		if leftIsEmpty {
+			child = rightHash
+		}
+		isLeaf, err := b.isLeaf(child)
+		if err != nil {
+			return nil, err
+		}
+		if isLeaf {
+			return child, nil
+		}
+	}
+
+	nodeHash, nodeData := st.digestNode(leftHash, rightHash)
+	b.newNodes = append(b.newNodes, [2][]byte{nodeHash, nodeData})
+	b.created[string(nodeHash)] = false
+	return nodeHash, nil
+}
+
+// isLeaf tells whether a new or stored node is a leaf.
+func (b *batchUpdate) isLeaf(nodeHash []byte) (bool, error) {
+	if isLeaf, ok := b.created[string(nodeHash)]; ok {
+		return isLeaf, nil
+	}
+	nodeData, err := b.smt.nodes.Get(nodeHash)
+	if err != nil {
+		return false, err
+	}
+	return b.smt.st.isLeaf(nodeData), nil
+}
+
+// apply writes the changes of the batch update to the MapDbs.
+func (b *batchUpdate) apply() error {
+	smt := b.smt
+	for _, nodeHash := range b.orphans {
+		if err := smt.deleteOrphan(nodeHash, false); err != nil {
+			return err
+		}
+	}
+	for _, nodeHash := range b.orphanLeaves {
+		if err := smt.deleteOrphan(nodeHash, true); err != nil {
+			return err
+		}
+	}
+	for _, node := range b.newNodes {
+		if err := smt.setNode(node[0], node[1]); err != nil {
+			return err
+		}
+	}
+	for _, path := range b.deletedValues {
+		if err := deleteIfExists(smt.values, path); err != nil {
+			return err
+		}
+		if err := smt.clearPreimage(path); err != nil {
+			return err
+		}
+	}
+	for _, entry := range b.setValues {
+		if err := smt.values.Set(entry.path, entry.value); err != nil {
+			return err
+		}
+		if err := smt.values.Set(entry.leafHash, entry.value); err != nil {
+			return err
+		}
+		if err := smt.setPreimage(entry.path, entry.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBatchEntries splits a sorted slice of entries by the bit at the given depth of their paths.
+func splitBatchEntries(entries []batchEntry, depth int) ([]batchEntry, []batchEntry) {
+	split := sort.Search(len(entries), func(i int) bool {
+		return getBitFromMSB(entries[i].path, depth) == right
+	})
+	return entries[:split], entries[split:]
+}
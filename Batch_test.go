@@ -0,0 +1,67 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// sameMaps fails the test if two Maps hold different entries, metadata included.
+func sameMaps(t *testing.T, name string, got, want *Map) {
+	t.Helper()
+	got.mu.RLock()
+	defer got.mu.RUnlock()
+	want.mu.RLock()
+	defer want.mu.RUnlock()
+	if len(got.m) != len(want.m) {
+		t.Fatalf("%s: %d entries, want %d", name, len(got.m), len(want.m))
+	}
+	for key, value := range want.m {
+		if gotValue, ok := got.m[key]; !ok || !bytes.Equal(gotValue, value) {
+			t.Fatalf("%s: entry %x differs", name, key)
+		}
+	}
+}
+
+func TestUpdateBatchMatchesUpdates(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithReferenceCounting()}, {WithPreimages(NewMap())}} {
+		rng := rand.New(rand.NewSource(11))
+		sequentialNodes, sequentialValues := NewMap(), NewMap()
+		batchNodes, batchValues := NewMap(), NewMap()
+		sequential := NewSparseMerkleTree(sequentialNodes, sequentialValues, NewSHA256Hasher(), opts...)
+		batch := NewSparseMerkleTree(batchNodes, batchValues, NewSHA256Hasher(), opts...)
+		for round := 0; round < 60; round++ {
+			// Keys repeat within a batch, and a third of the changes are deletes.
+			var keys, values [][]byte
+			for i := rng.Intn(200); i > 0; i-- {
+				key := []byte(fmt.Sprint("key", rng.Intn(300)))
+				var value []byte
+				if rng.Intn(3) != 0 {
+					value = []byte(fmt.Sprint("value", rng.Intn(3)))
+				}
+				keys = append(keys, key)
+				values = append(values, value)
+				if _, err := sequential.Update(key, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root, err := batch.UpdateBatch(keys, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(root, sequential.Root()) || !bytes.Equal(batch.Root(), root) {
+				t.Fatalf("round %d: batch root differs from sequential root", round)
+			}
+			sameMaps(t, "nodes", batchNodes, sequentialNodes)
+			sameMaps(t, "values", batchValues, sequentialValues)
+		}
+	}
+}
+
+func TestUpdateBatchRejectsMismatchedLengths(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	if _, err := smt.UpdateBatch([][]byte{[]byte("key")}, nil); err == nil {
+		t.Fatal("batch with more keys than values was applied")
+	}
+}
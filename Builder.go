@@ -0,0 +1,136 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// sortedBuilder builds a tree bottom-up from leaves added in increasing path order, keeping one
+// subtree per level of the path being built, so that its memory does not grow with the number of leaves.
+type sortedBuilder struct {
+	smt *SparseMerkleTree
+	// st hashes the nodes, and is the hasher of the tree unless the builder has its own.
+	st    *SmtHasher
+	stack []builderEntry
+	last  []byte
+}
+
+// builderEntry is a complete subtree of a sortedBuilder.
+type builderEntry struct {
+	hash []byte
+	// path is the path of the first leaf of the subtree.
+	path []byte
+	// depth is the depth of the root of the subtree, if it is an inner node.
+	depth  int
+	isLeaf bool
+	// split is the length of the common prefix of the first path of the subtree and the path of
+	// the leaf before it.
+	split int
+}
+
+func newSortedBuilder(smt *SparseMerkleTree) *sortedBuilder {
+	return &sortedBuilder{smt: smt, st: &smt.st}
+}
+
+// add stores the leaf of a path, adds it to the tree and returns its hash. Paths must be added in
+// increasing order.
+func (b *sortedBuilder) add(path, valueHash []byte) ([]byte, error) {
+	if b.last != nil && bytes.Compare(path, b.last) <= 0 {
+		return nil, errors.New("paths are not in increasing order")
+	}
+	leafHash, leafData := b.st.digestLeaf(path, valueHash)
+	if err := b.smt.setNode(leafHash, leafData); err != nil {
+		return nil, err
+	}
+	return leafHash, b.addSubtree(builderEntry{hash: leafHash, path: path, isLeaf: true})
+}
+
+// addSubtree adds a complete subtree whose paths all come after those added before.
+func (b *sortedBuilder) addSubtree(entry builderEntry) error {
+	if b.last != nil {
+		entry.split = countCommonPrefix(b.last, entry.path, b.smt.depth())
+		// Subtrees that split from each other deeper than from the new one are complete.
+		for len(b.stack) >= 2 && b.stack[len(b.stack)-1].split > entry.split {
+			if err := b.mergeTop(); err != nil {
+				return err
+			}
+		}
+	}
+	b.stack = append(b.stack, entry)
+	b.last = entry.path
+	return nil
+}
+
+// root completes the tree and returns its root.
+func (b *sortedBuilder) root() ([]byte, error) {
+	entry, ok, err := b.subtree()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return b.st.EmptyPlace(), nil
+	}
+	if entry, err = b.lift(entry, 0); err != nil {
+		return nil, err
+	}
+	return entry.hash, nil
+}
+
+// subtree completes the smallest subtree that holds all of the leaves added, and returns it
+// without lifting it to the root, or false if no leaf was added.
+func (b *sortedBuilder) subtree() (builderEntry, bool, error) {
+	if len(b.stack) == 0 {
+		return builderEntry{}, false, nil
+	}
+	for len(b.stack) >= 2 {
+		if err := b.mergeTop(); err != nil {
+			return builderEntry{}, false, err
+		}
+	}
+	return b.stack[0], true, nil
+}
+
+// mergeTop joins the two subtrees at the top of the stack under the node where their paths split.
+func (b *sortedBuilder) mergeTop() error {
+	left, right := b.stack[len(b.stack)-2], b.stack[len(b.stack)-1]
+	depth := right.split
+	left, err := b.lift(left, depth+1)
+	if err != nil {
+		return err
+	}
+	right, err = b.lift(right, depth+1)
+	if err != nil {
+		return err
+	}
+
+	nodeHash, nodeData := b.st.digestNode(left.hash, right.hash)
+	if err := b.smt.setNode(nodeHash, nodeData); err != nil {
+		return err
+	}
+	b.stack = b.stack[:len(b.stack)-1]
+	b.stack[len(b.stack)-1] = builderEntry{hash: nodeHash, path: left.path, depth: depth, split: left.split}
+	return nil
+}
+
+// lift moves the root of a subtree up to the given depth, by adding nodes with a EmptyPlace
+// sibling above it. A leaf is compacted instead, so it stays as it is.
+func (b *sortedBuilder) lift(entry builderEntry, depth int) (builderEntry, error) {
+	if entry.isLeaf {
+		return entry, nil
+	}
+	st := b.st
+	for entry.depth > depth {
+		entry.depth--
+		var nodeHash, nodeData []byte
+		if getBitFromMSB(entry.path, entry.depth) == right {
+			nodeHash, nodeData = st.digestNode(st.EmptyPlace(), entry.hash)
+		} else {
+			nodeHash, nodeData = st.digestNode(entry.hash, st.EmptyPlace())
+		}
+		if err := b.smt.setNode(nodeHash, nodeData); err != nil {
+			return builderEntry{}, err
+		}
+		entry.hash = nodeHash
+	}
+	return entry, nil
+}
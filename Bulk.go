@@ -0,0 +1,194 @@
+package smt
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// maxBulkBucketBits bounds the number of path bits that split the leaves of a bulk build.
+const maxBulkBucketBits = 16
+
+// BuildSparseMerkleTree creates a tree holding the given keys and values on empty MapDbs, with the
+// same root, nodes and values as calling Update for each of them, but faster. The leaves are
+// sorted by path and split by the first bits of their paths, and the subtree of each part is built
+// bottom-up on its own goroutine, which hashes with its own instance of the hash function. The
+// roots of the subtrees are then joined at the top. If a key is given more than once its last
+// value is used, and keys with the default value are left out. parallelism is the number of
+// goroutines, or GOMAXPROCS if it is not positive. The MapDbs must be safe for concurrent use, as
+// Map is. A TreeHasher that was not created by this package cannot be given its own instances, and
+// is only used with a parallelism of 1. MapDbs that are not empty are rejected, although a MapDb
+// that is not an IterableMapDb can only be checked for a tree stored in it.
+func BuildSparseMerkleTree(nodes, values MapDb, hasher TreeHasher, keys, vals [][]byte, parallelism int, options ...Option) (*SparseMerkleTree, error) {
+	if len(keys) != len(vals) {
+		return nil, errors.New("number of keys and values differ")
+	}
+	if parallelism < 1 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if parallelism > 1 && newHasherInstance(hasher) == nil {
+		return nil, fmt.Errorf("hasher %s may not be safe for concurrent use, and needs a parallelism of 1", hasher.Name())
+	}
+	if err := checkEmpty(nodes, "nodes"); err != nil {
+		return nil, err
+	}
+	if err := checkEmpty(values, "values"); err != nil {
+		return nil, err
+	}
+	smt := NewSparseMerkleTree(nodes, values, hasher, options...)
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+
+	// The keys are hashed in as many ranges as there are goroutines.
+	entries := make([]batchEntry, len(keys))
+	err := parallelize(parallelism, parallelism, func(g int) error {
+		st := smt.ownHasher(parallelism)
+		for i := g * len(keys) / parallelism; i < (g+1)*len(keys)/parallelism; i++ {
+			path, err := st.path(keys[i])
+			if err != nil {
+				return err
+			}
+			entries[i] = batchEntry{key: keys[i], path: path, value: vals[i]}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err = sortEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	leaves := entries[:0]
+	for _, entry := range entries {
+		if !entry.isDelete() {
+			leaves = append(leaves, entry)
+		}
+	}
+
+	buckets := splitBuckets(leaves, bucketBits(parallelism, smt.depth()))
+	subtrees := make([]builderEntry, len(buckets))
+	err = parallelize(len(buckets), parallelism, func(i int) error {
+		b := newSortedBuilder(smt)
+		b.st = smt.ownHasher(parallelism)
+		for _, entry := range buckets[i] {
+			leafHash, err := b.add(entry.path, b.st.digest(entry.value))
+			if err != nil {
+				return err
+			}
+			if err := smt.setLeafValue(RangeLeaf{Path: entry.path, Key: entry.key, Value: entry.value}, leafHash); err != nil {
+				return err
+			}
+		}
+		subtree, _, err := b.subtree()
+		subtrees[i] = subtree
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	top := newSortedBuilder(smt)
+	for _, subtree := range subtrees {
+		if err := top.addSubtree(subtree); err != nil {
+			return nil, err
+		}
+	}
+	root, err := top.root()
+	if err != nil {
+		return nil, err
+	}
+	if err := smt.moveRoot(root); err != nil {
+		return nil, err
+	}
+	smt.committedRoot = root
+	return smt, nil
+}
+
+// ownHasher returns the hasher of the tree for a single goroutine, or a copy of it with its own
+// instance of the TreeHasher for parallel goroutines.
+func (smt *SparseMerkleTree) ownHasher(parallelism int) *SmtHasher {
+	st := smt.st
+	if parallelism > 1 {
+		st.th = newHasherInstance(smt.st.th)
+	}
+	return &st
+}
+
+// errNotEmpty stops the iteration of a MapDb that is not empty.
+var errNotEmpty = errors.New("MapDb is not empty")
+
+// checkEmpty returns an error if a MapDb holds entries. A MapDb that is not an IterableMapDb is
+// only checked for the hasher that a tree stores in its nodes MapDb.
+func checkEmpty(db MapDb, name string) error {
+	var err error
+	if iterable, ok := db.(IterableMapDb); ok {
+		err = iterable.Iterate(func(_, _ []byte) error { return errNotEmpty })
+	} else if stored, getErr := getIfExists(db, hasherKey); getErr != nil {
+		err = getErr
+	} else if stored != nil {
+		err = errNotEmpty
+	}
+	if err == errNotEmpty {
+		return fmt.Errorf("%s MapDb is not empty", name)
+	}
+	return err
+}
+
+// bucketBits returns the number of path bits that split the leaves of a bulk build, so that there
+// are a few buckets for each goroutine.
+func bucketBits(parallelism, depth int) int {
+	bits := 0
+	for 1<<bits < 4*parallelism && bits < depth && bits < maxBulkBucketBits {
+		bits++
+	}
+	return bits
+}
+
+// splitBuckets splits leaves sorted by path into the runs that share their first bits. Subtrees
+// built from different runs share no nodes.
+func splitBuckets(leaves []batchEntry, bits int) [][]batchEntry {
+	var buckets [][]batchEntry
+	for start := 0; start < len(leaves); {
+		end := start + 1
+		for end < len(leaves) && countCommonPrefix(leaves[start].path, leaves[end].path, bits) == bits {
+			end++
+		}
+		buckets = append(buckets, leaves[start:end])
+		start = end
+	}
+	return buckets
+}
+
+// parallelize calls fn for each integer from 0 to n on the given number of goroutines, and returns
+// one of the errors returned by fn, if any.
+func parallelize(n, parallelism int, fn func(i int) error) error {
+	if parallelism > n {
+		parallelism = n
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, parallelism)
+	next := int64(-1)
+	for g := 0; g < parallelism; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
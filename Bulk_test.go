@@ -0,0 +1,125 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBuildSparseMerkleTreeMatchesUpdates(t *testing.T) {
+	for _, c := range []struct {
+		opts    func() []Option
+		rawKeys bool
+	}{
+		{func() []Option { return nil }, false},
+		{func() []Option { return []Option{WithReferenceCounting()} }, false},
+		{func() []Option { return []Option{WithDeferredWrites()} }, false},
+		{func() []Option { return []Option{WithDepth(20), WithRawKeys()} }, true},
+		{func() []Option { return []Option{WithPreimages(NewMap())} }, false},
+	} {
+		for _, numKeys := range []int{0, 1, 2, 7, 300, 3000} {
+			for _, parallelism := range []int{0, 1, 3, 16} {
+				name := fmt.Sprintf("%d options, %d keys, parallelism %d", len(c.opts()), numKeys, parallelism)
+				var keys, values [][]byte
+				for i := 0; i < numKeys; i++ {
+					key := []byte(fmt.Sprint("key", i))
+					if c.rawKeys {
+						// Keys of 20 bits.
+						key = []byte{byte(i * 7), byte(i >> 3), byte(i*13) & 0xf0}
+					}
+					keys = append(keys, key)
+					values = append(values, []byte(fmt.Sprint("value", i)))
+				}
+				// A key given again is set to its last value, or deleted.
+				if numKeys > 5 {
+					keys = append(keys, keys[2], keys[3])
+					values = append(values, []byte("last value"), DefaultVal)
+				}
+
+				nodes, treeValues := NewMap(), NewMap()
+				smt, err := BuildSparseMerkleTree(nodes, treeValues, NewSHA256Hasher(), keys, values, parallelism, c.opts()...)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				updatedNodes, updatedValues := NewMap(), NewMap()
+				updated := NewSparseMerkleTree(updatedNodes, updatedValues, NewSHA256Hasher(), c.opts()...)
+				for i := range keys {
+					if _, err := updated.Update(keys[i], values[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				smt.Commit()
+				updated.Commit()
+				if !bytes.Equal(smt.Root(), updated.Root()) {
+					t.Fatalf("%s: root differs from the root after updates", name)
+				}
+				if numKeys == 0 {
+					// Only the built tree records its hasher.
+					sameEntries(t, name+": nodes", nodes, updatedNodes)
+					continue
+				}
+				sameMaps(t, name+": nodes", nodes, updatedNodes)
+				sameMaps(t, name+": values", treeValues, updatedValues)
+			}
+		}
+	}
+}
+
+func TestBuildSparseMerkleTreeRejectsInvalidInput(t *testing.T) {
+	if _, err := BuildSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), [][]byte{[]byte("key")}, nil, 1); err == nil {
+		t.Fatal("tree was built with more keys than values")
+	}
+	keys, values := [][]byte{{1, 2}, {1, 2, 3}}, [][]byte{[]byte("value"), []byte("value")}
+	if _, err := BuildSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), keys, values, 1, WithDepth(16), WithRawKeys()); err == nil {
+		t.Fatal("tree was built with a raw key of the wrong size")
+	}
+}
+
+// wrappedHasher is a TreeHasher that was not created by this package.
+type wrappedHasher struct {
+	TreeHasher
+}
+
+// plainMapDb is a MapDb that cannot be iterated.
+type plainMapDb struct {
+	MapDb
+}
+
+func TestBuildSparseMerkleTreeHashersAndMapDbs(t *testing.T) {
+	keys, values := [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")}, [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	for _, hasher := range []TreeHasher{NewBlake2bHasher(), NewPoseidonHasher()} {
+		smt, err := BuildSparseMerkleTree(NewMap(), NewMap(), hasher, keys, values, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated := NewSparseMerkleTree(NewMap(), NewMap(), hasher)
+		updated.UpdateBatch(keys, values)
+		if !bytes.Equal(smt.Root(), updated.Root()) {
+			t.Fatalf("%s: root differs from the root after updates", hasher.Name())
+		}
+	}
+
+	// A hasher that may not be safe for concurrent use is only used by one goroutine.
+	hasher := wrappedHasher{NewSHA256Hasher()}
+	if _, err := BuildSparseMerkleTree(NewMap(), NewMap(), hasher, keys, values, 4); err == nil {
+		t.Fatal("tree was built on several goroutines with a hasher of another package")
+	}
+	if _, err := BuildSparseMerkleTree(NewMap(), NewMap(), hasher, keys, values, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, treeValues := NewMap(), NewMap()
+	NewSparseMerkleTree(nodes, treeValues, NewSHA256Hasher()).Update([]byte("key"), []byte("value"))
+	if _, err := BuildSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher(), keys, values, 1); err == nil {
+		t.Fatal("tree was built on nodes that are not empty")
+	}
+	if _, err := BuildSparseMerkleTree(NewMap(), treeValues, NewSHA256Hasher(), keys, values, 1); err == nil {
+		t.Fatal("tree was built on values that are not empty")
+	}
+	if _, err := BuildSparseMerkleTree(plainMapDb{nodes}, NewMap(), NewSHA256Hasher(), keys, values, 1); err == nil {
+		t.Fatal("tree was built on nodes holding a tree")
+	}
+	if _, err := BuildSparseMerkleTree(plainMapDb{NewMap()}, plainMapDb{NewMap()}, NewSHA256Hasher(), keys, values, 1); err != nil {
+		t.Fatal(err)
+	}
+}
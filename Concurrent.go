@@ -0,0 +1,201 @@
+package smt
+
+import (
+	"io"
+	"sync"
+)
+
+// ConcurrentSparseMerkleTree is a SparseMerkleTree that is safe for concurrent use. Reads run
+// concurrently with each other, and writes run alone. The MapDbs of the tree must be safe for
+// concurrent use, as Map is, and so must its TreeHasher.
+type ConcurrentSparseMerkleTree struct {
+	mu  sync.RWMutex
+	smt *SparseMerkleTree
+}
+
+// NewConcurrentSparseMerkleTree creates a new ConcurrentSparseMerkleTree on empty MapDbs.
+func NewConcurrentSparseMerkleTree(nodes, values MapDb, hasher TreeHasher, options ...Option) *ConcurrentSparseMerkleTree {
+	return &ConcurrentSparseMerkleTree{smt: NewSparseMerkleTree(nodes, values, hasher, options...)}
+}
+
+// NewConcurrent makes a SparseMerkleTree safe for concurrent use. The tree must not be used
+// directly anymore.
+func NewConcurrent(smt *SparseMerkleTree) *ConcurrentSparseMerkleTree {
+	return &ConcurrentSparseMerkleTree{smt: smt}
+}
+
+// Read calls fn with the tree locked for reading, for reads that are not wrapped. fn must not
+// update the tree, nor call the ConcurrentSparseMerkleTree.
+func (c *ConcurrentSparseMerkleTree) Read(fn func(smt *SparseMerkleTree) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fn(c.smt)
+}
+
+// Write calls fn with the tree locked for writing, for updates that are not wrapped, or for
+// several updates that must be seen at once. fn must not call the ConcurrentSparseMerkleTree.
+func (c *ConcurrentSparseMerkleTree) Write(fn func(smt *SparseMerkleTree) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fn(c.smt)
+}
+
+// Reads.
+
+func (c *ConcurrentSparseMerkleTree) Root() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Root()
+}
+
+func (c *ConcurrentSparseMerkleTree) Get(key []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Get(key)
+}
+
+func (c *ConcurrentSparseMerkleTree) Check(key []byte) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Check(key)
+}
+
+func (c *ConcurrentSparseMerkleTree) GetAt(key, root []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.GetAt(key, root)
+}
+
+func (c *ConcurrentSparseMerkleTree) CheckAt(key, root []byte) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.CheckAt(key, root)
+}
+
+func (c *ConcurrentSparseMerkleTree) Prove(key []byte) (SparseMerkleProof, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Prove(key)
+}
+
+func (c *ConcurrentSparseMerkleTree) ProveAt(key, root []byte) (SparseMerkleProof, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.ProveAt(key, root)
+}
+
+func (c *ConcurrentSparseMerkleTree) ProveMulti(keys [][]byte) (SparseMerkleMultiProof, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.ProveMulti(keys)
+}
+
+func (c *ConcurrentSparseMerkleTree) ProveRange(root, start, end []byte) ([]RangeLeaf, SparseMerkleRangeProof, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.ProveRange(root, start, end)
+}
+
+func (c *ConcurrentSparseMerkleTree) KeyOf(path []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.KeyOf(path)
+}
+
+// Iterate is SparseMerkleTree.Iterate, with the tree locked for reading until it returns. fn must
+// not call the ConcurrentSparseMerkleTree.
+func (c *ConcurrentSparseMerkleTree) Iterate(root, fromPath []byte, fn func(path, key, valueHash, value []byte) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Iterate(root, fromPath, fn)
+}
+
+// Diff is SparseMerkleTree.Diff, with the tree locked for reading until it returns. fn must not
+// call the ConcurrentSparseMerkleTree.
+func (c *ConcurrentSparseMerkleTree) Diff(oldRoot, newRoot []byte, fn func(diff LeafDiff) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.Diff(oldRoot, newRoot, fn)
+}
+
+func (c *ConcurrentSparseMerkleTree) ExportSnapshot(root []byte, w io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.ExportSnapshot(root, w)
+}
+
+func (c *ConcurrentSparseMerkleTree) SyncChunk(root []byte, index, chunkBits int) (SyncChunk, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.SyncChunk(root, index, chunkBits)
+}
+
+func (c *ConcurrentSparseMerkleTree) ServeReconcile(rw io.ReadWriter, root []byte) (ReconcileStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.smt.ServeReconcile(rw, root)
+}
+
+// Snapshot returns a read-only view of the tree at its current root, which is read without
+// locking the tree (see SparseMerkleTree.Snapshot). The snapshot of a tree that counts references
+// holds a reference to its root, and is taken with the tree locked for writing.
+func (c *ConcurrentSparseMerkleTree) Snapshot() (*TreeSnapshot, error) {
+	if c.smt.refCounted {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	} else {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+	}
+	return c.smt.Snapshot()
+}
+
+// Writes.
+
+func (c *ConcurrentSparseMerkleTree) Update(key, value []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Update(key, value)
+}
+
+func (c *ConcurrentSparseMerkleTree) Delete(key []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Delete(key)
+}
+
+func (c *ConcurrentSparseMerkleTree) UpdateBatch(keys, values [][]byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.UpdateBatch(keys, values)
+}
+
+func (c *ConcurrentSparseMerkleTree) SetRoot(root []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.smt.SetRoot(root)
+}
+
+func (c *ConcurrentSparseMerkleTree) Commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Commit()
+}
+
+func (c *ConcurrentSparseMerkleTree) Discard() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Discard()
+}
+
+func (c *ConcurrentSparseMerkleTree) Prune(retainedRoots [][]byte) (PruneResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Prune(retainedRoots)
+}
+
+func (c *ConcurrentSparseMerkleTree) Reconcile(rw io.ReadWriter) (ReconcileStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.smt.Reconcile(rw)
+}
@@ -0,0 +1,156 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// The tests of this file are meant to be run with the race detector, as go test -race.
+
+func TestConcurrentSparseMerkleTree(t *testing.T) {
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithReferenceCounting()} },
+		func() []Option { return []Option{WithDeferredWrites(), WithPreimages(NewMap())} },
+	} {
+		for _, hasher := range []TreeHasher{NewSHA256Hasher(), NewBlake2bHasher()} {
+			name := fmt.Sprintf("%d options, %s", len(opts()), hasher.Name())
+			c := NewConcurrentSparseMerkleTree(NewMap(), NewMap(), hasher, opts()...)
+			for i := 0; i < 50; i++ {
+				c.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for w := 0; w < 2; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 60; i++ {
+						key := []byte(fmt.Sprint("key", (i*7+w)%80))
+						var err error
+						if i%5 == 4 {
+							_, err = c.Delete(key)
+						} else {
+							_, err = c.Update(key, []byte(fmt.Sprint("value", w, i)))
+						}
+						if err == nil && i%20 == 19 {
+							err = c.Commit()
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(w)
+			}
+			for r := 0; r < 6; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					for i := 0; i < 60; i++ {
+						key := []byte(fmt.Sprint("key", (i*3+r)%80))
+						// The root, the value and the proof are read at once.
+						err := c.Read(func(smt *SparseMerkleTree) error {
+							root := smt.Root()
+							value, err := smt.Get(key)
+							if err != nil {
+								return err
+							}
+							proof, err := smt.Prove(key)
+							if err != nil {
+								return err
+							}
+							if !VerifyProof(proof, root, key, value, hasher) {
+								return fmt.Errorf("proof of %s does not verify", key)
+							}
+							return nil
+						})
+						// A root read alone may be gone by the time it is used, unless the tree keeps its orphans.
+						if err == nil && i%10 == 0 {
+							err = c.Read(func(smt *SparseMerkleTree) error {
+								return smt.Iterate(smt.Root(), nil, func(_, _, _, _ []byte) error { return nil })
+							})
+						}
+						if err == nil {
+							_, err = c.Get(key)
+						}
+						if err == nil && i%15 == 0 {
+							var snapshot *TreeSnapshot
+							if snapshot, err = c.Snapshot(); err == nil {
+								_, err = snapshot.Get(key)
+								snapshot.Release()
+							}
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(r)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestMapConcurrentAccess(t *testing.T) {
+	m := NewMap()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprint("key", (g*31+i)%50))
+				switch i % 4 {
+				case 0:
+					m.Set(key, []byte("value"))
+				case 1:
+					m.Get(key)
+				case 2:
+					m.Delete(key)
+				default:
+					m.Iterate(func(_, _ []byte) error { return nil })
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestTreeHasherConcurrentUse(t *testing.T) {
+	for _, hasher := range []TreeHasher{NewSHA256Hasher(), NewSHA3Hasher(), NewKeccak256Hasher(), NewBlake2bHasher(), NewPoseidonHasher()} {
+		// The hashes computed concurrently with the pooled states match those computed alone.
+		want := make([][]byte, 50)
+		for i := range want {
+			want[i] = hasher.Node(hasher.Path([]byte(fmt.Sprint("key", i))), hasher.Value([]byte(fmt.Sprint("value", i))))
+		}
+		var wg sync.WaitGroup
+		failed := make(chan int, 16)
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range want {
+					got := hasher.Node(hasher.Path([]byte(fmt.Sprint("key", i))), hasher.Value([]byte(fmt.Sprint("value", i))))
+					if !bytes.Equal(got, want[i]) {
+						failed <- i
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(failed)
+		for i := range failed {
+			t.Fatalf("%s: hash %d differs when computed concurrently", hasher.Name(), i)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package smt
+
+import (
+	"errors"
+	"sync"
+)
+
+// WithDeferredWrites keeps the nodes and values written and deleted by updates in memory, on top of
+// the MapDbs of the tree, until Commit is called. Only the net result of the changes reaches the
+// MapDbs, so a node that is created and orphaned between two commits is never written.
+func WithDeferredWrites() Option {
+	return func(tree *SparseMerkleTree) {
+		tree.deferredWrites = true
+	}
+}
+
+// deferWrites puts an overlay on top of each MapDb of the tree.
+func (smt *SparseMerkleTree) deferWrites() {
+	smt.nodes = newOverlayMapDb(smt.nodes)
+	smt.values = newOverlayMapDb(smt.values)
+	if smt.preimages != nil {
+		smt.preimages = newOverlayMapDb(smt.preimages)
+	}
+}
+
+// overlays returns the overlays on top of the MapDbs of the tree, if writes are deferred.
+func (smt *SparseMerkleTree) overlays() []*overlayMapDb {
+	var overlays []*overlayMapDb
+	for _, db := range []MapDb{smt.nodes, smt.values, smt.preimages} {
+		if overlay, ok := db.(*overlayMapDb); ok {
+			overlays = append(overlays, overlay)
+		}
+	}
+	return overlays
+}
+
+// Commit writes the changes made since the last commit to the MapDbs of the tree.
+// Without WithDeferredWrites, changes are written as they are made and Commit does nothing.
+func (smt *SparseMerkleTree) Commit() error {
+	for _, overlay := range smt.overlays() {
+		if err := overlay.flush(); err != nil {
+			return err
+		}
+	}
+	smt.commitPins()
+	smt.committedRoot = smt.Root()
+	return nil
+}
+
+// Discard throws away the changes made since the last commit, and resets the tree to the root it
+// had then. Without WithDeferredWrites, changes are already written and Discard does nothing.
+func (smt *SparseMerkleTree) Discard() error {
+	if !smt.deferredWrites {
+		return nil
+	}
+	for _, overlay := range smt.overlays() {
+		overlay.reset()
+	}
+	smt.SetRoot(smt.committedRoot)
+	// The hasher may have been recorded in the discarded changes.
+	smt.hasherChecked = false
+	return smt.discardPins()
+}
+
+// overlayMapDb is a MapDb that keeps its changes in memory on top of another MapDb.
+// Reads go through the changes to the underlying MapDb. It is safe for concurrent use if the
+// underlying MapDb is.
+type overlayMapDb struct {
+	mu      sync.RWMutex
+	db      MapDb
+	sets    map[string][]byte
+	deletes map[string]bool
+}
+
+func newOverlayMapDb(db MapDb) *overlayMapDb {
+	o := &overlayMapDb{db: db}
+	o.reset()
+	return o
+}
+
+// Get gets the value for a key.
+func (o *overlayMapDb) Get(key []byte) ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if value, ok := o.sets[string(key)]; ok {
+		return value, nil
+	}
+	if o.deletes[string(key)] {
+		return nil, &InvalidKey{Key: key}
+	}
+	return o.db.Get(key)
+}
+
+// Set updates the value for a key.
+func (o *overlayMapDb) Set(key []byte, value []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.deletes, string(key))
+	o.sets[string(key)] = value
+	return nil
+}
+
+// Delete deletes a key. The deletion only reaches the underlying MapDb if the key is stored there.
+func (o *overlayMapDb) Delete(key []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, isSet := o.sets[string(key)]
+	if !isSet && o.deletes[string(key)] {
+		return &InvalidKey{Key: key}
+	}
+	delete(o.sets, string(key))
+
+	stored, err := getIfExists(o.db, key)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		o.deletes[string(key)] = true
+	} else if !isSet {
+		return &InvalidKey{Key: key}
+	}
+	return nil
+}
+
+// Iterate calls fn for every entry, in no particular order, until fn returns an error.
+// The underlying MapDb must be an IterableMapDb.
+func (o *overlayMapDb) Iterate(fn func(key, value []byte) error) error {
+	db, ok := o.db.(IterableMapDb)
+	if !ok {
+		return errors.New("underlying MapDb cannot be iterated")
+	}
+	// The changes are copied, so that fn may update the overlay.
+	o.mu.RLock()
+	sets := make(map[string][]byte, len(o.sets))
+	for key, value := range o.sets {
+		sets[key] = value
+	}
+	deletes := make(map[string]bool, len(o.deletes))
+	for key := range o.deletes {
+		deletes[key] = true
+	}
+	o.mu.RUnlock()
+
+	for key, value := range sets {
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return db.Iterate(func(key, value []byte) error {
+		if _, ok := sets[string(key)]; ok || deletes[string(key)] {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+// flush writes the changes to the underlying MapDb, and clears them.
+func (o *overlayMapDb) flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key := range o.deletes {
+		if err := o.db.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	for key, value := range o.sets {
+		if err := o.db.Set([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	o.clear()
+	return nil
+}
+
+// reset clears the changes.
+func (o *overlayMapDb) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clear()
+}
+
+func (o *overlayMapDb) clear() {
+	o.sets = make(map[string][]byte)
+	o.deletes = make(map[string]bool)
+}
@@ -0,0 +1,144 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// countingMap is a Map that counts the writes that reach it.
+type countingMap struct {
+	*Map
+	sets, deletes int
+}
+
+func (m *countingMap) Set(key, value []byte) error {
+	m.sets++
+	return m.Map.Set(key, value)
+}
+
+func (m *countingMap) Delete(key []byte) error {
+	m.deletes++
+	return m.Map.Delete(key)
+}
+
+func TestDeferredWritesMatchImmediateWrites(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithReferenceCounting()}, {WithOrphanRetention()}} {
+		rng := rand.New(rand.NewSource(3))
+		immediateNodes, immediateValues := NewMap(), NewMap()
+		deferredNodes, deferredValues := &countingMap{Map: NewMap()}, &countingMap{Map: NewMap()}
+		immediate := NewSparseMerkleTree(immediateNodes, immediateValues, NewSHA256Hasher(), opts...)
+		deferred := NewSparseMerkleTree(deferredNodes, deferredValues, NewSHA256Hasher(), append(opts, WithDeferredWrites())...)
+		committedSets, committedValueSets := 0, 0
+		for round := 0; round < 30; round++ {
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprint("key", rng.Intn(80)))
+				value := []byte(fmt.Sprint("value", rng.Intn(5)))
+				if rng.Intn(4) == 0 {
+					value = DefaultVal
+				}
+				immediateRoot, err := immediate.Update(key, value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				deferredRoot, err := deferred.Update(key, value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(immediateRoot, deferredRoot) {
+					t.Fatalf("round %d: roots differ", round)
+				}
+				immediateValue, _ := immediate.Get(key)
+				deferredValue, _ := deferred.Get(key)
+				if !bytes.Equal(immediateValue, deferredValue) {
+					t.Fatalf("round %d: %s reads %q, want %q", round, key, deferredValue, immediateValue)
+				}
+			}
+			if deferredNodes.sets != committedSets || deferredValues.sets != committedValueSets {
+				t.Fatalf("round %d: writes reached the MapDbs before Commit", round)
+			}
+			if err := deferred.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			committedSets, committedValueSets = deferredNodes.sets, deferredValues.sets
+			sameMaps(t, "nodes", deferredNodes.Map, immediateNodes)
+			sameMaps(t, "values", deferredValues.Map, immediateValues)
+		}
+	}
+}
+
+func TestDeferredWritesWriteTheNetChange(t *testing.T) {
+	nodes := &countingMap{Map: NewMap()}
+	smt := NewSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher(), WithDeferredWrites())
+	for i := 0; i < 100; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte("value"))
+	}
+	if err := smt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	sets, deletes := nodes.sets, nodes.deletes
+
+	// Nodes created and orphaned between two commits never reach the MapDb.
+	for i := 0; i < 10; i++ {
+		smt.Update([]byte("key0"), []byte(fmt.Sprint("value", i)))
+	}
+	if nodes.sets != sets || nodes.deletes != deletes {
+		t.Fatal("writes reached the MapDb before Commit")
+	}
+	path, _ := smt.st.path([]byte("key0"))
+	_, pathNodes, _, _, _ := smt.sideNodesForRoot(path, smt.Root(), false)
+	if err := smt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if written := nodes.sets - sets; written != len(pathNodes) {
+		t.Fatalf("commit wrote %d nodes, want the %d nodes of the last update", written, len(pathNodes))
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDeferredWrites())
+	smt.Update([]byte("key1"), []byte("value1"))
+	smt.Commit()
+	root := smt.Root()
+	smt.Update([]byte("key2"), []byte("value2"))
+	smt.Delete([]byte("key1"))
+	if err := smt.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(smt.Root(), root) {
+		t.Fatal("Discard did not restore the root")
+	}
+	if value, _ := smt.Get([]byte("key1")); string(value) != "value1" {
+		t.Fatalf("key1 reads %q after Discard", value)
+	}
+	if present, _ := smt.Check([]byte("key2")); present {
+		t.Fatal("discarded key2 is present")
+	}
+
+	// A versioned tree also restores the versions changed since the last commit.
+	vt, err := NewVersionedSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDeferredWrites())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt.Update([]byte("key"), []byte("value1"))
+	version1, _ := vt.Commit()
+	vt.Update([]byte("key"), []byte("value2"))
+	version2, _ := vt.Commit()
+	if err := vt.Rollback(version1); err != nil {
+		t.Fatal(err)
+	}
+	if err := vt.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if len(vt.Versions()) != 2 {
+		t.Fatalf("versions after Discard %v", vt.Versions())
+	}
+	root2, _ := vt.RootAt(version2)
+	if !bytes.Equal(vt.Root(), root2) {
+		t.Fatal("Discard did not restore the root of the last version")
+	}
+	if value, _ := vt.Get([]byte("key")); string(value) != "value2" {
+		t.Fatalf("key reads %q after Discard", value)
+	}
+}
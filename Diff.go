@@ -0,0 +1,164 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// DiffKind tells how a leaf differs between two roots.
+type DiffKind int
+
+const (
+	// Added is a leaf that is only under the new root.
+	Added DiffKind = iota
+	// Removed is a leaf that is only under the old root.
+	Removed
+	// Changed is a leaf whose value differs between the two roots.
+	Changed
+)
+
+// LeafDiff is a leaf that differs between two roots.
+type LeafDiff struct {
+	Kind DiffKind
+	Path []byte
+	// Key is the key of the path, if the tree has a preimage store that holds it, and nil otherwise.
+	Key      []byte
+	OldValue []byte // OldValue is nil for an added leaf.
+	NewValue []byte // NewValue is nil for a removed leaf.
+}
+
+// diffLeaf is a leaf being compared by Diff.
+type diffLeaf struct {
+	path      []byte
+	valueHash []byte
+	value     []byte
+}
+
+// Diff calls fn for every leaf that differs between two roots whose nodes are in the tree, in path
+// order. Only the subtrees whose hashes differ are visited, so the cost is proportional to the
+// number of differences. The iteration stops when fn returns an error, which is returned unless it
+// is ErrStopIteration.
+func (smt *SparseMerkleTree) Diff(oldRoot, newRoot []byte, fn func(diff LeafDiff) error) error {
+	err := smt.diffNodes(oldRoot, newRoot, 0, fn)
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// diffNodes compares the subtrees at the given depth under the two roots.
+func (smt *SparseMerkleTree) diffNodes(oldHash, newHash []byte, depth int, fn func(diff LeafDiff) error) error {
+	if bytes.Equal(oldHash, newHash) {
+		return nil
+	}
+	oldLeaf, oldData, err := smt.diffNode(oldHash)
+	if err != nil {
+		return err
+	}
+	newLeaf, newData, err := smt.diffNode(newHash)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case oldData == nil && newData == nil:
+		// Both subtrees are a leaf or a EmptyPlace.
+		return smt.diffLeaves(optionalLeaf(oldLeaf), optionalLeaf(newLeaf), fn)
+	case oldData == nil:
+		// The old subtree is a leaf or a EmptyPlace, and every leaf of the new subtree is a difference.
+		newLeaves, err := smt.subtreeLeaves(newHash, depth)
+		if err != nil {
+			return err
+		}
+		return smt.diffLeaves(optionalLeaf(oldLeaf), newLeaves, fn)
+	case newData == nil:
+		oldLeaves, err := smt.subtreeLeaves(oldHash, depth)
+		if err != nil {
+			return err
+		}
+		return smt.diffLeaves(oldLeaves, optionalLeaf(newLeaf), fn)
+	}
+	if depth >= smt.depth() {
+		return errors.New("node is deeper than the tree")
+	}
+
+	oldLeft, oldRight := smt.st.parseNode(oldData)
+	newLeft, newRight := smt.st.parseNode(newData)
+	if err := smt.diffNodes(oldLeft, newLeft, depth+1, fn); err != nil {
+		return err
+	}
+	return smt.diffNodes(oldRight, newRight, depth+1, fn)
+}
+
+// diffNode reads a node for Diff. It returns the leaf if the node is a leaf, the node data if it
+// is an inner node, and neither if it is a EmptyPlace.
+func (smt *SparseMerkleTree) diffNode(nodeHash []byte) (*diffLeaf, []byte, error) {
+	if bytes.Equal(nodeHash, smt.st.EmptyPlace()) {
+		return nil, nil, nil
+	}
+	data, err := smt.nodes.Get(nodeHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !smt.st.isLeaf(data) {
+		return nil, data, nil
+	}
+	path, valueHash := smt.st.parseLeaf(data)
+	value, err := smt.leafValue(nodeHash, path, valueHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &diffLeaf{path: path, valueHash: valueHash, value: value}, nil, nil
+}
+
+// subtreeLeaves returns the leaves of a subtree in path order.
+func (smt *SparseMerkleTree) subtreeLeaves(nodeHash []byte, depth int) ([]diffLeaf, error) {
+	var leaves []diffLeaf
+	err := smt.iterateNode(nodeHash, nil, depth, func(path, _, valueHash, value []byte) error {
+		leaves = append(leaves, diffLeaf{path: path, valueHash: valueHash, value: value})
+		return nil
+	})
+	return leaves, err
+}
+
+// diffLeaves calls fn for the differences between two sets of leaves sorted by path.
+func (smt *SparseMerkleTree) diffLeaves(oldLeaves, newLeaves []diffLeaf, fn func(diff LeafDiff) error) error {
+	for len(oldLeaves) > 0 || len(newLeaves) > 0 {
+		var diff LeafDiff
+		switch {
+		case len(newLeaves) == 0 || len(oldLeaves) > 0 && bytes.Compare(oldLeaves[0].path, newLeaves[0].path) < 0:
+			diff = LeafDiff{Kind: Removed, Path: oldLeaves[0].path, OldValue: oldLeaves[0].value}
+			oldLeaves = oldLeaves[1:]
+		case len(oldLeaves) == 0 || bytes.Compare(oldLeaves[0].path, newLeaves[0].path) > 0:
+			diff = LeafDiff{Kind: Added, Path: newLeaves[0].path, NewValue: newLeaves[0].value}
+			newLeaves = newLeaves[1:]
+		default:
+			unchanged := bytes.Equal(oldLeaves[0].valueHash, newLeaves[0].valueHash)
+			diff = LeafDiff{Kind: Changed, Path: oldLeaves[0].path, OldValue: oldLeaves[0].value, NewValue: newLeaves[0].value}
+			oldLeaves, newLeaves = oldLeaves[1:], newLeaves[1:]
+			if unchanged {
+				continue
+			}
+		}
+
+		if smt.preimages != nil {
+			key, err := getIfExists(smt.preimages, diff.Path)
+			if err != nil {
+				return err
+			}
+			diff.Key = key
+		}
+		if err := fn(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionalLeaf returns a slice holding the leaf, if it is not nil.
+func optionalLeaf(leaf *diffLeaf) []diffLeaf {
+	if leaf == nil {
+		return nil
+	}
+	return []diffLeaf{*leaf}
+}
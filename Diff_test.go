@@ -0,0 +1,108 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithOrphanRetention(), WithPreimages(NewMap()))
+	model := make(map[string]string)
+	for round := 0; round < 40; round++ {
+		oldRoot := smt.Root()
+		oldModel := make(map[string]string, len(model))
+		for k, v := range model {
+			oldModel[k] = v
+		}
+		updates := rng.Intn(30)
+		if round == 0 {
+			updates = 300
+		}
+		for i := 0; i < updates; i++ {
+			key := fmt.Sprint("key", rng.Intn(400))
+			value := fmt.Sprint("value", rng.Intn(3))
+			if rng.Intn(3) == 0 {
+				value = ""
+			}
+			smt.Update([]byte(key), []byte(value))
+			if value == "" {
+				delete(model, key)
+			} else {
+				model[key] = value
+			}
+		}
+
+		want := make(map[string]string)
+		for key, value := range model {
+			if oldValue, ok := oldModel[key]; !ok {
+				want[key] = "added " + value
+			} else if oldValue != value {
+				want[key] = "changed " + oldValue + " to " + value
+			}
+		}
+		for key, oldValue := range oldModel {
+			if _, ok := model[key]; !ok {
+				want[key] = "removed " + oldValue
+			}
+		}
+
+		got := make(map[string]string)
+		var previous []byte
+		err := smt.Diff(oldRoot, smt.Root(), func(diff LeafDiff) error {
+			if previous != nil && bytes.Compare(previous, diff.Path) >= 0 {
+				t.Fatalf("round %d: diff of %x comes after %x", round, diff.Path, previous)
+			}
+			previous = diff.Path
+			if keyPath, _ := smt.st.path(diff.Key); !bytes.Equal(keyPath, diff.Path) {
+				t.Fatalf("round %d: diff of %x has key %q", round, diff.Path, diff.Key)
+			}
+			switch diff.Kind {
+			case Added:
+				got[string(diff.Key)] = "added " + string(diff.NewValue)
+			case Removed:
+				got[string(diff.Key)] = "removed " + string(diff.OldValue)
+			case Changed:
+				got[string(diff.Key)] = "changed " + string(diff.OldValue) + " to " + string(diff.NewValue)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("round %d: %d differences, want %d", round, len(got), len(want))
+		}
+		for key, change := range want {
+			if got[key] != change {
+				t.Fatalf("round %d: %s %s, want %s", round, key, got[key], change)
+			}
+		}
+	}
+}
+
+func TestDiffStopsEarly(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 20; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte("value"))
+	}
+	count := 0
+	err := smt.Diff(smt.st.EmptyPlace(), smt.Root(), func(diff LeafDiff) error {
+		if diff.Kind != Added || diff.Key != nil {
+			t.Fatalf("unexpected difference %+v", diff)
+		}
+		count++
+		if count == 5 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || count != 5 {
+		t.Fatalf("Diff returned %v after %d differences", err, count)
+	}
+	if err := smt.Diff(smt.Root(), smt.Root(), func(LeafDiff) error { return fmt.Errorf("difference") }); err != nil {
+		t.Fatal("a root differs from itself")
+	}
+}
@@ -0,0 +1,69 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrStopIteration can be returned by the function given to Iterate to stop the iteration without an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// Iterate calls fn for every leaf of the tree at the given root whose path is not before fromPath,
+// in path order, with the path, the key, the value hash and the value of the leaf. The key is read
+// from the preimage store of the tree, and is nil if the tree has none or it does not hold the key.
+// A nil fromPath starts at the first leaf. The iteration stops when fn returns an error, which is
+// returned unless it is ErrStopIteration. Passing the path of the last leaf seen plus one as
+// fromPath resumes an iteration.
+func (smt *SparseMerkleTree) Iterate(root, fromPath []byte, fn func(path, key, valueHash, value []byte) error) error {
+	if fromPath != nil && len(fromPath) != smt.st.pathSize() {
+		return errors.New("invalid path size")
+	}
+	err := smt.iterateNode(root, fromPath, 0, fn)
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// iterateNode visits the leaves of the subtree at the given depth. fromPath is nil once the
+// subtree is known to lie entirely after the start of the iteration.
+func (smt *SparseMerkleTree) iterateNode(nodeHash, fromPath []byte, depth int, fn func(path, key, valueHash, value []byte) error) error {
+	if bytes.Equal(nodeHash, smt.st.EmptyPlace()) {
+		return nil
+	}
+	data, err := smt.nodes.Get(nodeHash)
+	if err != nil {
+		return err
+	}
+
+	if smt.st.isLeaf(data) {
+		path, valueHash := smt.st.parseLeaf(data)
+		if fromPath != nil && bytes.Compare(path, fromPath) < 0 {
+			return nil
+		}
+		value, err := smt.leafValue(nodeHash, path, valueHash)
+		if err != nil {
+			return err
+		}
+		var key []byte
+		if smt.preimages != nil {
+			if key, err = getIfExists(smt.preimages, path); err != nil {
+				return err
+			}
+		}
+		return fn(path, key, valueHash, value)
+	}
+	if depth >= smt.depth() {
+		return errors.New("node is deeper than the tree")
+	}
+
+	leftNode, rightNode := smt.st.parseNode(data)
+	if fromPath != nil && getBitFromMSB(fromPath, depth) == right {
+		// The left subtree lies entirely before the start of the iteration.
+		return smt.iterateNode(rightNode, fromPath, depth+1, fn)
+	}
+	if err := smt.iterateNode(leftNode, fromPath, depth+1, fn); err != nil {
+		return err
+	}
+	return smt.iterateNode(rightNode, nil, depth+1, fn)
+}
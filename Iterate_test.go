@@ -0,0 +1,127 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+// nextPath returns the path that follows a path, to resume an iteration after it.
+func nextPath(path []byte) []byte {
+	next := new(big.Int).SetBytes(path)
+	next.Add(next, big.NewInt(1))
+	return next.FillBytes(make([]byte, len(path)))
+}
+
+func TestIterate(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	var paths [][]byte
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		smt.Update(key, []byte(fmt.Sprint("value", i)))
+		path, _ := smt.st.path(key)
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return bytes.Compare(paths[i], paths[j]) < 0 })
+
+	var got [][]byte
+	err := smt.Iterate(smt.Root(), nil, func(path, _, valueHash, value []byte) error {
+		if !bytes.Equal(smt.st.digest(value), valueHash) {
+			t.Fatalf("value of %x does not match its hash", path)
+		}
+		got = append(got, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(paths) {
+		t.Fatalf("iterated %d leaves, want %d", len(got), len(paths))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], paths[i]) {
+			t.Fatalf("leaf %d is %x, want %x", i, got[i], paths[i])
+		}
+	}
+
+	// Arbitrary start paths.
+	for i := 0; i < 50; i++ {
+		fromPath := smt.st.digest([]byte(fmt.Sprint("cursor", i)))
+		first := sort.Search(len(paths), func(j int) bool { return bytes.Compare(paths[j], fromPath) >= 0 })
+		count := 0
+		err := smt.Iterate(smt.Root(), fromPath, func(path, _, _, _ []byte) error {
+			if !bytes.Equal(path, paths[first+count]) {
+				t.Fatalf("leaf %d from %x is %x, want %x", count, fromPath, path, paths[first+count])
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(paths)-first {
+			t.Fatalf("iterated %d leaves from %x, want %d", count, fromPath, len(paths)-first)
+		}
+	}
+}
+
+func TestIteratePages(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 500; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	var all [][]byte
+	smt.Iterate(smt.Root(), nil, func(path, _, _, _ []byte) error {
+		all = append(all, path)
+		return nil
+	})
+
+	var fromPath []byte
+	var paged [][]byte
+	for {
+		var page [][]byte
+		err := smt.Iterate(smt.Root(), fromPath, func(path, _, _, _ []byte) error {
+			page = append(page, path)
+			if len(page) == 37 {
+				return ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, page...)
+		if len(page) < 37 {
+			break
+		}
+		fromPath = nextPath(page[len(page)-1])
+	}
+	if len(paged) != len(all) {
+		t.Fatalf("pages hold %d leaves, want %d", len(paged), len(all))
+	}
+	for i := range paged {
+		if !bytes.Equal(paged[i], all[i]) {
+			t.Fatalf("paged leaf %d differs", i)
+		}
+	}
+}
+
+func TestIterateErrors(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	smt.Update([]byte("key1"), []byte("value1"))
+	smt.Update([]byte("key2"), []byte("value2"))
+	errStop := errors.New("stop")
+	if err := smt.Iterate(smt.Root(), nil, func(_, _, _, _ []byte) error { return errStop }); err != errStop {
+		t.Fatalf("Iterate returned %v, want the error of fn", err)
+	}
+	if err := smt.Iterate(smt.Root(), []byte("short"), func(_, _, _, _ []byte) error { return nil }); err == nil {
+		t.Fatal("start path of the wrong size was accepted")
+	}
+	called := false
+	if err := smt.Iterate(smt.st.EmptyPlace(), nil, func(_, _, _, _ []byte) error { called = true; return nil }); err != nil || called {
+		t.Fatal("empty tree has leaves")
+	}
+}
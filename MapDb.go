@@ -1,6 +1,10 @@
 package smt
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
 
 // MapDb is a key-value storage like a Database.
 type MapDb interface {
@@ -9,6 +13,12 @@ type MapDb interface {
 	Delete(key []byte) error            // Delete deletes a key.
 }
 
+// IterableMapDb is a MapDb whose entries can be listed.
+type IterableMapDb interface {
+	MapDb
+	Iterate(fn func(key, value []byte) error) error // Iterate calls fn for every entry, in no particular order, until fn returns an error.
+}
+
 // InvalidKey is thrown when a key that does not exist is being accessed.
 type InvalidKey struct {
 	Key []byte
@@ -18,9 +28,30 @@ func (e *InvalidKey) Error() string {
 	return fmt.Sprintf("invalid key: %x", e.Key)
 }
 
-// Map is a simple in-memory map.
+// deleteIfExists deletes a key from a MapDb, ignoring the InvalidKey error of a key that does not exist.
+func deleteIfExists(db MapDb, key []byte) error {
+	err := db.Delete(key)
+	var invalidKeyError *InvalidKey
+	if errors.As(err, &invalidKeyError) {
+		return nil
+	}
+	return err
+}
+
+// getIfExists gets the value for a key from a MapDb, or nil if the key does not exist.
+func getIfExists(db MapDb, key []byte) ([]byte, error) {
+	value, err := db.Get(key)
+	var invalidKeyError *InvalidKey
+	if errors.As(err, &invalidKeyError) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Map is a simple in-memory map. It is safe for concurrent use.
 type Map struct {
-	m map[string][]byte
+	mu sync.RWMutex
+	m  map[string][]byte
 }
 
 //NewMap creates a new empty SimpleMap.
@@ -32,6 +63,8 @@ func NewMap() *Map {
 
 // Get gets the value for a key.
 func (sm *Map) Get(key []byte) ([]byte, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 	if value, ok := sm.m[string(key)]; ok {
 		return value, nil
 	}
@@ -40,12 +73,16 @@ func (sm *Map) Get(key []byte) ([]byte, error) {
 
 // Set updates the value for a key.
 func (sm *Map) Set(key []byte, value []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 	sm.m[string(key)] = value
 	return nil
 }
 
 // Delete deletes a key.
 func (sm *Map) Delete(key []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 	_, ok := sm.m[string(key)]
 	if ok {
 		delete(sm.m, string(key))
@@ -53,3 +90,23 @@ func (sm *Map) Delete(key []byte) error {
 	}
 	return &InvalidKey{Key: key}
 }
+
+// Iterate calls fn for every entry, in no particular order, until fn returns an error.
+// The entries are those of the map when Iterate is called, and fn may update the map.
+func (sm *Map) Iterate(fn func(key, value []byte) error) error {
+	sm.mu.RLock()
+	keys := make([]string, 0, len(sm.m))
+	values := make([][]byte, 0, len(sm.m))
+	for key, value := range sm.m {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	sm.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// migrationBatchSize is the number of entries written to the migrated tree at once.
+const migrationBatchSize = 1024
+
+// RootMigration records that a root built with one hasher holds the same entries as a root built
+// with another, as attested by the signature of the party that migrated the tree.
+type RootMigration struct {
+	OldHasher string
+	OldRoot   []byte
+	NewHasher string
+	NewRoot   []byte
+	// Signature is the ed25519 signature of the other fields.
+	Signature []byte
+}
+
+// message encodes the signed fields of a migration, each prefixed with its length.
+func (m *RootMigration) message() []byte {
+	msg := []byte("smt:migration")
+	length := make([]byte, 4)
+	for _, field := range [][]byte{[]byte(m.OldHasher), m.OldRoot, []byte(m.NewHasher), m.NewRoot} {
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		msg = append(append(msg, length...), field...)
+	}
+	return msg
+}
+
+// VerifyRootMigration verifies the signature of a migration against the public key of the party that migrated the tree.
+func VerifyRootMigration(m RootMigration, publicKey ed25519.PublicKey) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, m.message(), m.Signature)
+}
+
+// MigrateHasher rebuilds the tree at its current root with another hasher in new MapDbs, and returns
+// the new tree together with the mapping from the old root to the new one, signed with signingKey.
+// As the tree only stores the paths of its keys, keyOf must return the key that hashes to a path.
+// If keyOf is nil, keys are read from the preimage store of the tree (see WithPreimages).
+//
+// The migration only reads the nodes of the root it starts from, so the tree keeps serving reads
+// from that root while it runs. Updates must wait until it returns, unless orphans are retained.
+func (smt *SparseMerkleTree) MigrateHasher(nodes, values MapDb, hasher TreeHasher, keyOf func(path []byte) ([]byte, error), signingKey ed25519.PrivateKey, opts ...Option) (*SparseMerkleTree, RootMigration, error) {
+	if len(signingKey) != ed25519.PrivateKeySize {
+		return nil, RootMigration{}, errors.New("invalid signing key")
+	}
+	if keyOf == nil {
+		keyOf = smt.KeyOf
+	}
+	oldRoot := smt.Root()
+	migrated := NewSparseMerkleTree(nodes, values, hasher, opts...)
+
+	var keys, batchValues [][]byte
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if _, err := migrated.UpdateBatch(keys, batchValues); err != nil {
+			return err
+		}
+		keys, batchValues = nil, nil
+		return nil
+	}
+	err := smt.Iterate(oldRoot, nil, func(path, _, _, value []byte) error {
+		key, err := keyOf(path)
+		if err != nil {
+			return err
+		}
+		keyPath, err := smt.st.path(key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(keyPath, path) {
+			return &InvalidKey{Key: key}
+		}
+		keys = append(keys, key)
+		batchValues = append(batchValues, value)
+		if len(keys) < migrationBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		// Record the hasher even if the tree is empty.
+		err = migrated.checkHasher()
+	}
+	if err != nil {
+		return nil, RootMigration{}, err
+	}
+
+	migration := RootMigration{
+		OldHasher: smt.st.name(),
+		OldRoot:   oldRoot,
+		NewHasher: migrated.st.name(),
+		NewRoot:   migrated.Root(),
+	}
+	migration.Signature = ed25519.Sign(signingKey, migration.message())
+	return migrated, migration, nil
+}
@@ -0,0 +1,105 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestOpeningWithAnotherHasherFails(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	smt := NewSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	smt.Update([]byte("key"), []byte("value"))
+
+	var invalidHasher *InvalidHasher
+	if _, err := ImportSparseMerkleTree(nodes, values, NewKeccak256Hasher(), smt.Root()); !errors.As(err, &invalidHasher) {
+		t.Fatalf("import with another hasher returned %v", err)
+	}
+	if _, err := NewVersionedSparseMerkleTree(nodes, values, NewKeccak256Hasher()); !errors.As(err, &invalidHasher) {
+		t.Fatalf("versioned tree with another hasher returned %v", err)
+	}
+	// Every write path checks the hasher.
+	for name, write := range map[string]func(other *SparseMerkleTree) error{
+		"Update": func(other *SparseMerkleTree) error {
+			_, err := other.Update([]byte("key"), []byte("other"))
+			return err
+		},
+		"RootUpdate": func(other *SparseMerkleTree) error {
+			_, err := other.RootUpdate([]byte("key"), []byte("other"), smt.Root())
+			return err
+		},
+		"DeleteRoot": func(other *SparseMerkleTree) error {
+			_, err := other.DeleteRoot([]byte("key"), smt.Root())
+			return err
+		},
+		"RootUpdateBatch": func(other *SparseMerkleTree) error {
+			_, err := other.RootUpdateBatch([][]byte{[]byte("key")}, [][]byte{[]byte("other")}, smt.Root())
+			return err
+		},
+		"Prune": func(other *SparseMerkleTree) error {
+			_, err := other.Prune([][]byte{smt.Root()})
+			return err
+		},
+	} {
+		other := NewSparseMerkleTree(nodes, values, NewKeccak256Hasher())
+		if err := write(other); !errors.As(err, &invalidHasher) {
+			t.Fatalf("%s with another hasher returned %v", name, err)
+		}
+	}
+	if _, err := ImportSparseMerkleTree(nodes, values, NewSHA256Hasher(), smt.Root()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateHasher(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	smt := NewSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	keyOfPath := make(map[string][]byte)
+	var keys, vals [][]byte
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		path, _ := smt.st.path(key)
+		keyOfPath[string(path)] = key
+		keys = append(keys, key)
+		vals = append(vals, []byte(fmt.Sprint("value", i)))
+	}
+	smt.UpdateBatch(keys, vals)
+	smt.Delete([]byte("key5"))
+
+	signingKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	newNodes, newValues := NewMap(), NewMap()
+	keyOf := func(path []byte) ([]byte, error) { return keyOfPath[string(path)], nil }
+	migrated, migration, err := smt.MigrateHasher(newNodes, newValues, NewKeccak256Hasher(), keyOf, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := NewSparseMerkleTree(NewMap(), NewMap(), NewKeccak256Hasher())
+	want.UpdateBatch(keys, vals)
+	want.Delete([]byte("key5"))
+	if !bytes.Equal(migrated.Root(), want.Root()) || !bytes.Equal(migration.NewRoot, want.Root()) {
+		t.Fatal("migrated root differs from a tree built with the new hasher")
+	}
+	if !bytes.Equal(migration.OldRoot, smt.Root()) {
+		t.Fatal("migration does not record the old root")
+	}
+	if value, _ := migrated.Get([]byte("key7")); string(value) != "value7" {
+		t.Fatalf("key7 reads %q in the migrated tree", value)
+	}
+
+	if !VerifyRootMigration(migration, publicKey) {
+		t.Fatal("migration signature does not verify")
+	}
+	forged := migration
+	forged.NewRoot = smt.Root()
+	if VerifyRootMigration(forged, publicKey) {
+		t.Fatal("forged migration verifies")
+	}
+	var invalidHasher *InvalidHasher
+	if _, err := NewVersionedSparseMerkleTree(newNodes, newValues, NewSHA256Hasher()); !errors.As(err, &invalidHasher) {
+		t.Fatalf("migrated tree opens with the old hasher: %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// SparseMerkleMultiProof is a Merkle proof for a set of elements in a SparseMerkleTree.
+// Side nodes shared by several paths are only included once.
+type SparseMerkleMultiProof struct {
+	// Flags is a bit mask with one bit per node visited by a depth-first,
+	// left-to-right walk from the root, where an on-bit indicates that the walk
+	// descends into the node and an off-bit indicates that the node is a leaf or a EmptyPlace.
+	Flags []byte
+
+	// SideNodes is an array of the non-EmptyPlace sibling nodes of the subtrees
+	// the walk did not descend into, in the order the walk visits them.
+	SideNodes [][]byte
+
+	// BitMask is a bit mask of the sibling nodes of the walk where an on-bit
+	// indicates that the sibling at the bit's index is a EmptyPlace.
+	BitMask []byte
+
+	// NumSideNodes indicates the number of sibling nodes, including EmptyPlaces.
+	NumSideNodes int
+
+	// NonMembershipLeafData has one entry per leaf or EmptyPlace reached by the
+	// walk. It holds the data of the leaf if the leaf is unrelated to all of the
+	// keys being proven, and nil otherwise.
+	NonMembershipLeafData [][]byte
+}
+
+// multiProofEntry is a path being proven together with its claimed value.
+type multiProofEntry struct {
+	path  []byte
+	value []byte
+}
+
+// sanityCheck checks that the sizes of the multiproof fields are consistent with the hasher.
+func (proof *SparseMerkleMultiProof) sanityCheck(st *SmtHasher) error {
+	if proof.NumSideNodes < 0 || len(proof.BitMask) != (proof.NumSideNodes+7)/8 {
+		return errors.New("invalid bit mask length")
+	}
+	if len(proof.SideNodes) != proof.NumSideNodes-countSetBits(proof.BitMask) {
+		return errors.New("side nodes do not match the bit mask")
+	}
+	for _, sideNode := range proof.SideNodes {
+		if len(sideNode) != st.pathSize() {
+			return errors.New("invalid side node size")
+		}
+	}
+	for _, leafData := range proof.NonMembershipLeafData {
+		if leafData != nil && len(leafData) != len(leafPrefix)+st.pathSize()*2 {
+			return errors.New("invalid non-membership leaf data")
+		}
+	}
+	return nil
+}
+
+// ProveMulti generates a single Merkle proof for a set of keys against the current root.
+func (smt *SparseMerkleTree) ProveMulti(keys [][]byte) (SparseMerkleMultiProof, error) {
+	return smt.proveMultiForRoot(keys, smt.Root())
+}
+
+// proveMultiForRoot generates a Merkle proof for a set of keys against a specific root.
+// The nodes are walked once for all of the paths.
+func (smt *SparseMerkleTree) proveMultiForRoot(keys [][]byte, root []byte) (SparseMerkleMultiProof, error) {
+	paths := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		path, err := smt.st.path(key)
+		if err != nil {
+			return SparseMerkleMultiProof{}, err
+		}
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return bytes.Compare(paths[i], paths[j]) < 0
+	})
+
+	b := multiProofBuilder{smt: smt}
+	if err := b.walk(root, dedupPaths(paths), 0); err != nil {
+		return SparseMerkleMultiProof{}, err
+	}
+
+	return SparseMerkleMultiProof{
+		Flags:                 b.flags,
+		SideNodes:             b.sideNodes,
+		BitMask:               b.bitMask,
+		NumSideNodes:          b.numSideNodes,
+		NonMembershipLeafData: b.leafData,
+	}, nil
+}
+
+// multiProofBuilder accumulates the fields of a multiproof during the walk.
+type multiProofBuilder struct {
+	smt          *SparseMerkleTree
+	flags        []byte
+	numFlags     int
+	sideNodes    [][]byte
+	bitMask      []byte
+	numSideNodes int
+	leafData     [][]byte
+}
+
+func (b *multiProofBuilder) addFlag(descend bool) {
+	if b.numFlags%8 == 0 {
+		b.flags = append(b.flags, 0)
+	}
+	if descend {
+		setBitFromMSB(b.flags, b.numFlags)
+	}
+	b.numFlags++
+}
+
+func (b *multiProofBuilder) addSideNode(sideNode []byte) {
+	if b.numSideNodes%8 == 0 {
+		b.bitMask = append(b.bitMask, 0)
+	}
+	if bytes.Equal(sideNode, b.smt.st.EmptyPlace()) {
+		setBitFromMSB(b.bitMask, b.numSideNodes)
+	} else {
+		b.sideNodes = append(b.sideNodes, sideNode)
+	}
+	b.numSideNodes++
+}
+
+// walk visits the node at the given depth that all of the paths go through.
+func (b *multiProofBuilder) walk(nodeHash []byte, paths [][]byte, depth int) error {
+	st := &b.smt.st
+	if bytes.Equal(nodeHash, st.EmptyPlace()) {
+		b.addFlag(false)
+		b.leafData = append(b.leafData, nil)
+		return nil
+	}
+
+	nodeData, err := b.smt.nodes.Get(nodeHash)
+	if err != nil {
+		return err
+	}
+	if st.isLeaf(nodeData) {
+		b.addFlag(false)
+		actualPath, _ := st.parseLeaf(nodeData)
+		for _, path := range paths {
+			if bytes.Equal(path, actualPath) {
+				// The leaf proves the membership of one of the paths.
+				nodeData = nil
+				break
+			}
+		}
+		b.leafData = append(b.leafData, nodeData)
+		return nil
+	}
+	if depth >= b.smt.depth() {
+		return errors.New("node is deeper than the tree")
+	}
+
+	b.addFlag(true)
+	leftNode, rightNode := st.parseNode(nodeData)
+	leftPaths, rightPaths := splitPaths(paths, depth)
+	if len(leftPaths) == 0 {
+		b.addSideNode(leftNode)
+	} else if err := b.walk(leftNode, leftPaths, depth+1); err != nil {
+		return err
+	}
+	if len(rightPaths) == 0 {
+		b.addSideNode(rightNode)
+	} else if err := b.walk(rightNode, rightPaths, depth+1); err != nil {
+		return err
+	}
+	return nil
+}
+
+// VerifyMultiProof verifies a Merkle multiproof for a set of keys and their values against a root.
+// A DefaultVal value verifies that the corresponding key is not present in the tree.
+// The options must be those of the tree, as they determine the paths of the keys.
+func VerifyMultiProof(proof SparseMerkleMultiProof, root []byte, keys, values [][]byte, hasher TreeHasher, opts ...Option) bool {
+	if len(keys) != len(values) {
+		return false
+	}
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return false
+	}
+	if err := proof.sanityCheck(st); err != nil {
+		return false
+	}
+
+	entries := make([]multiProofEntry, 0, len(keys))
+	for i, key := range keys {
+		path, err := st.path(key)
+		if err != nil {
+			return false
+		}
+		entries = append(entries, multiProofEntry{path: path, value: values[i]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].path, entries[j].path) < 0
+	})
+	// Remove duplicate keys, which must all claim the same value.
+	unique := entries[:0]
+	for _, entry := range entries {
+		if len(unique) > 0 && bytes.Equal(unique[len(unique)-1].path, entry.path) {
+			if !bytes.Equal(unique[len(unique)-1].value, entry.value) {
+				return false
+			}
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	v := multiProofVerifier{st: st, proof: &proof}
+	currentHash, ok := v.walk(unique, 0)
+	if !ok {
+		return false
+	}
+
+	// The whole proof must have been consumed.
+	if len(proof.Flags) != (v.flagPos+7)/8 || v.sideNodePos != proof.NumSideNodes || v.leafDataPos != len(proof.NonMembershipLeafData) {
+		return false
+	}
+	return bytes.Equal(currentHash, root)
+}
+
+// multiProofVerifier keeps track of the position in each field of a multiproof during verification.
+type multiProofVerifier struct {
+	st          *SmtHasher
+	proof       *SparseMerkleMultiProof
+	flagPos     int
+	sideNodePos int
+	position    int
+	leafDataPos int
+}
+
+// walk recomputes the hash of the node at the given depth that all of the entries go through.
+func (v *multiProofVerifier) walk(entries []multiProofEntry, depth int) ([]byte, bool) {
+	if v.flagPos >= len(v.proof.Flags)*8 {
+		return nil, false
+	}
+	descend := getBitFromMSB(v.proof.Flags, v.flagPos) == 1
+	v.flagPos++
+
+	if !descend {
+		return v.terminal(entries)
+	}
+	if depth >= v.st.depth {
+		return nil, false
+	}
+
+	var leftHash, rightHash []byte
+	var ok bool
+	leftEntries, rightEntries := splitEntries(entries, depth)
+	if len(leftEntries) == 0 {
+		leftHash, ok = v.nextSideNode()
+	} else {
+		leftHash, ok = v.walk(leftEntries, depth+1)
+	}
+	if !ok {
+		return nil, false
+	}
+	if len(rightEntries) == 0 {
+		rightHash, ok = v.nextSideNode()
+	} else {
+		rightHash, ok = v.walk(rightEntries, depth+1)
+	}
+	if !ok {
+		return nil, false
+	}
+
+	currentHash, _ := v.st.digestNode(leftHash, rightHash)
+	return currentHash, true
+}
+
+// terminal computes the hash of a leaf or EmptyPlace that all of the entries lead to.
+func (v *multiProofVerifier) terminal(entries []multiProofEntry) ([]byte, bool) {
+	if v.leafDataPos >= len(v.proof.NonMembershipLeafData) {
+		return nil, false
+	}
+	leafData := v.proof.NonMembershipLeafData[v.leafDataPos]
+	v.leafDataPos++
+
+	if leafData != nil {
+		// Leaf is an unrelated leaf, so every entry must be a non-membership claim.
+		actualPath, valueHash := v.st.parseLeaf(leafData)
+		for _, entry := range entries {
+			if !bytes.Equal(entry.value, DefaultVal) || bytes.Equal(entry.path, actualPath) {
+				return nil, false
+			}
+		}
+		currentHash, _ := v.st.digestLeaf(actualPath, valueHash)
+		return currentHash, true
+	}
+
+	// Leaf is either a EmptyPlace or the leaf of the single entry with a value.
+	var member *multiProofEntry
+	for i := range entries {
+		if bytes.Equal(entries[i].value, DefaultVal) {
+			continue
+		}
+		if member != nil {
+			return nil, false
+		}
+		member = &entries[i]
+	}
+	if member == nil {
+		return v.st.EmptyPlace(), true
+	}
+	currentHash, _ := v.st.digestLeaf(member.path, v.st.digest(member.value))
+	return currentHash, true
+}
+
+func (v *multiProofVerifier) nextSideNode() ([]byte, bool) {
+	if v.sideNodePos >= v.proof.NumSideNodes {
+		return nil, false
+	}
+	isEmptyPlace := getBitFromMSB(v.proof.BitMask, v.sideNodePos) == 1
+	v.sideNodePos++
+	if isEmptyPlace {
+		return v.st.EmptyPlace(), true
+	}
+	sideNode := v.proof.SideNodes[v.position]
+	v.position++
+	return sideNode, true
+}
+
+// dedupPaths removes duplicates from a sorted slice of paths.
+func dedupPaths(paths [][]byte) [][]byte {
+	unique := paths[:0]
+	for _, path := range paths {
+		if len(unique) == 0 || !bytes.Equal(unique[len(unique)-1], path) {
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+// splitPaths splits a sorted slice of paths by the bit at the given depth.
+func splitPaths(paths [][]byte, depth int) ([][]byte, [][]byte) {
+	split := sort.Search(len(paths), func(i int) bool {
+		return getBitFromMSB(paths[i], depth) == right
+	})
+	return paths[:split], paths[split:]
+}
+
+// splitEntries splits a sorted slice of entries by the bit at the given depth of their paths.
+func splitEntries(entries []multiProofEntry, depth int) ([]multiProofEntry, []multiProofEntry) {
+	split := sort.Search(len(entries), func(i int) bool {
+		return getBitFromMSB(entries[i].path, depth) == right
+	})
+	return entries[:split], entries[split:]
+}
@@ -0,0 +1,119 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestProveMultiAndVerifyMultiProof(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	model := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key, value := []byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))
+		smt.Update(key, value)
+		model[string(key)] = value
+	}
+	for i := 0; i < 500; i += 3 {
+		key := []byte(fmt.Sprint("key", i))
+		smt.Delete(key)
+		delete(model, string(key))
+	}
+	root := smt.Root()
+
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 50; round++ {
+		// Keys may repeat, and some are absent from the tree.
+		var keys, values [][]byte
+		for j := rng.Intn(60); j > 0; j-- {
+			key := []byte(fmt.Sprint("key", rng.Intn(700)))
+			keys = append(keys, key)
+			values = append(values, model[string(key)])
+		}
+		proof, err := smt.ProveMulti(keys)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if !VerifyMultiProof(proof, root, keys, values, NewSHA256Hasher()) {
+			t.Fatalf("round %d: multiproof does not verify", round)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		// The side nodes are those of the single proofs, each once, without the placeholders and the
+		// nodes on the path of another key.
+		want := make(map[string]bool)
+		for _, key := range keys {
+			p, err := smt.Prove(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, sideNode := range p.SideNodes {
+				if !bytes.Equal(sideNode, smt.st.EmptyPlace()) {
+					want[string(sideNode)] = true
+				}
+			}
+		}
+		for _, key := range keys {
+			path, _ := smt.st.path(key)
+			_, pathNodes, _, _, err := smt.sideNodesForRoot(path, root, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pathNode := range pathNodes {
+				delete(want, string(pathNode))
+			}
+		}
+		if len(proof.SideNodes) != len(want) {
+			t.Fatalf("round %d: multiproof has %d side nodes, want %d", round, len(proof.SideNodes), len(want))
+		}
+		for _, sideNode := range proof.SideNodes {
+			if !want[string(sideNode)] {
+				t.Fatalf("round %d: multiproof has side node %x, which is not a side node of the single proofs", round, sideNode)
+			}
+			delete(want, string(sideNode))
+		}
+
+		wrong := append([][]byte{}, values...)
+		wrong[rng.Intn(len(wrong))] = []byte("wrong")
+		if VerifyMultiProof(proof, root, keys, wrong, NewSHA256Hasher()) {
+			t.Fatalf("round %d: multiproof verifies a wrong value", round)
+		}
+	}
+}
+
+func TestVerifyMultiProofRejectsMalformedProofs(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 50; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	keys := [][]byte{[]byte("key1"), []byte("key20"), []byte("absent")}
+	values := [][]byte{[]byte("value1"), []byte("value20"), DefaultVal}
+	proof, err := smt.ProveMulti(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := smt.Root()
+
+	missingSide := proof
+	missingSide.SideNodes = proof.SideNodes[1:]
+	shortSide := proof
+	shortSide.SideNodes = append([][]byte{[]byte("short")}, proof.SideNodes[1:]...)
+	truncatedFlags := proof
+	truncatedFlags.Flags = nil
+
+	for name, bad := range map[string]SparseMerkleMultiProof{
+		"missing side node": missingSide,
+		"short side node":   shortSide,
+		"truncated flags":   truncatedFlags,
+	} {
+		if VerifyMultiProof(bad, root, keys, values, NewSHA256Hasher()) {
+			t.Errorf("%s: multiproof verifies", name)
+		}
+	}
+	if VerifyMultiProof(proof, root, keys[:2], values[:2], NewSHA256Hasher()) {
+		t.Error("multiproof verifies for a subset of its keys")
+	}
+}
@@ -0,0 +1,253 @@
+package smt
+
+import (
+	"math/big"
+	"sync"
+)
+
+// poseidonModulus is the order of the scalar field of BN254, on which the circuits of circom operate.
+var poseidonModulus, _ = new(big.Int).SetString("21888242871839275222246405745257275088548364400416034343698204186575808495617", 10)
+
+const (
+	poseidonFullRounds = 8
+	// poseidonChunkSize is the number of bytes packed in each field element, so that it is below the modulus.
+	poseidonChunkSize = 31
+)
+
+// poseidonPartialRounds is the number of partial rounds for each width, from 2 to 5, as in circomlib.
+var poseidonPartialRounds = []int{56, 57, 56, 60}
+
+// poseidonParams are the round constants and the MDS matrix of Poseidon for one width.
+type poseidonParams struct {
+	once      sync.Once
+	constants []*big.Int
+	mds       [][]*big.Int
+}
+
+var poseidonParamsByWidth [6]poseidonParams
+
+// PoseidonHasher is a TreeHasher using the Poseidon hash over the BN254 scalar field, with the
+// parameters of circomlib, so that roots and proofs can be verified with few constraints in circuits.
+// Every hash is a field element encoded as 32 big-endian bytes, and the EmptyPlace is zero.
+//
+// A leaf is hashed as Poseidon(path, valueHash, 1) and a node as Poseidon(left, right).
+// Keys and values are split into 31-byte big-endian field elements m1..mk, and hashed as
+// h0 = len(data), hi = Poseidon(hi-1, mi), so that data of any length maps to a field element.
+type PoseidonHasher struct{}
+
+// NewPoseidonHasher creates a TreeHasher using Poseidon.
+func NewPoseidonHasher() TreeHasher {
+	return PoseidonHasher{}
+}
+
+func (PoseidonHasher) Path(key []byte) []byte {
+	return poseidonFieldBytes(poseidonHashBytes(key))
+}
+
+func (PoseidonHasher) Value(value []byte) []byte {
+	return poseidonFieldBytes(poseidonHashBytes(value))
+}
+
+func (PoseidonHasher) Leaf(path, valueHash []byte) []byte {
+	return poseidonFieldBytes(Poseidon(poseidonElement(path), poseidonElement(valueHash), big.NewInt(1)))
+}
+
+func (PoseidonHasher) Node(leftHash, rightHash []byte) []byte {
+	return poseidonFieldBytes(Poseidon(poseidonElement(leftHash), poseidonElement(rightHash)))
+}
+
+func (PoseidonHasher) Size() int {
+	return 32
+}
+
+func (PoseidonHasher) Name() string {
+	return "poseidon-bn254-circom"
+}
+
+// Poseidon hashes 1 to 4 field elements, as the Poseidon template of circomlib does.
+// Inputs are reduced modulo the field order. It panics for other numbers of inputs.
+func Poseidon(inputs ...*big.Int) *big.Int {
+	if len(inputs) == 0 || len(inputs) > len(poseidonPartialRounds) {
+		panic("poseidon: invalid number of inputs")
+	}
+	width := len(inputs) + 1
+	params := poseidonParamsFor(width)
+	partialRounds := poseidonPartialRounds[width-2]
+
+	state := make([]*big.Int, width)
+	state[0] = new(big.Int)
+	for i, input := range inputs {
+		state[i+1] = new(big.Int).Mod(input, poseidonModulus)
+	}
+
+	rounds := poseidonFullRounds + partialRounds
+	for r := 0; r < rounds; r++ {
+		for i := range state {
+			state[i].Add(state[i], params.constants[r*width+i])
+		}
+		// Full rounds apply the S-box to the whole state, and partial rounds to its first element only.
+		if r < poseidonFullRounds/2 || r >= poseidonFullRounds/2+partialRounds {
+			for i := range state {
+				poseidonSbox(state[i])
+			}
+		} else {
+			poseidonSbox(state[0])
+		}
+
+		mixed := make([]*big.Int, width)
+		product := new(big.Int)
+		for i := range mixed {
+			mixed[i] = new(big.Int)
+			for j := range state {
+				mixed[i].Add(mixed[i], product.Mul(params.mds[i][j], state[j]))
+			}
+			mixed[i].Mod(mixed[i], poseidonModulus)
+		}
+		state = mixed
+	}
+	return state[0]
+}
+
+// poseidonSbox raises a field element to the fifth power in place.
+func poseidonSbox(x *big.Int) {
+	square := new(big.Int).Mul(x, x)
+	square.Mod(square, poseidonModulus)
+	square.Mul(square, square)
+	x.Mul(x, square).Mod(x, poseidonModulus)
+}
+
+// poseidonHashBytes maps data of any length to a field element.
+func poseidonHashBytes(data []byte) *big.Int {
+	h := big.NewInt(int64(len(data)))
+	for i := 0; i < len(data); i += poseidonChunkSize {
+		end := i + poseidonChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		h = Poseidon(h, new(big.Int).SetBytes(data[i:end]))
+	}
+	return h
+}
+
+// poseidonElement decodes a 32-byte hash into a field element.
+func poseidonElement(data []byte) *big.Int {
+	return new(big.Int).SetBytes(data)
+}
+
+// poseidonFieldBytes encodes a field element as 32 big-endian bytes.
+func poseidonFieldBytes(x *big.Int) []byte {
+	return x.FillBytes(make([]byte, 32))
+}
+
+// poseidonParamsFor returns the parameters for a width, generating them on first use.
+func poseidonParamsFor(width int) *poseidonParams {
+	params := &poseidonParamsByWidth[width]
+	params.once.Do(func() {
+		params.constants, params.mds = generatePoseidonParams(width, poseidonPartialRounds[width-2])
+	})
+	return params
+}
+
+// generatePoseidonParams generates the round constants and the MDS matrix of a width with the
+// Grain LFSR of the reference implementation of Poseidon, from which the constants of circomlib come.
+func generatePoseidonParams(width, partialRounds int) ([]*big.Int, [][]*big.Int) {
+	const fieldBits = 254
+	g := newGrainLFSR(fieldBits, width, poseidonFullRounds, partialRounds)
+
+	constants := make([]*big.Int, 0, (poseidonFullRounds+partialRounds)*width)
+	for len(constants) < cap(constants) {
+		c := g.nextInt(fieldBits)
+		if c.Cmp(poseidonModulus) < 0 {
+			constants = append(constants, c)
+		}
+	}
+
+	// The MDS matrix is the Cauchy matrix M[i][j] = 1 / (x[i] + y[j]) of 2*width distinct elements.
+	// The reference implementation also checks the matrix against invariant subspace attacks, which
+	// the first matrix passes for the supported widths, so the check is not repeated here.
+	for {
+		elements := make([]*big.Int, 2*width)
+		distinct := make(map[string]bool)
+		for i := range elements {
+			elements[i] = g.nextInt(fieldBits)
+			elements[i].Mod(elements[i], poseidonModulus)
+			distinct[elements[i].String()] = true
+		}
+		if len(distinct) != len(elements) {
+			continue
+		}
+
+		mds := make([][]*big.Int, width)
+		valid := true
+		for i := range mds {
+			mds[i] = make([]*big.Int, width)
+			for j := range mds[i] {
+				sum := new(big.Int).Add(elements[i], elements[width+j])
+				sum.Mod(sum, poseidonModulus)
+				if sum.Sign() == 0 {
+					valid = false
+					break
+				}
+				mds[i][j] = sum.ModInverse(sum, poseidonModulus)
+			}
+		}
+		if valid {
+			return constants, mds
+		}
+	}
+}
+
+// grainLFSR is the self-shrinking Grain LFSR used to generate the parameters of Poseidon.
+type grainLFSR struct {
+	state [80]byte
+}
+
+func newGrainLFSR(fieldBits, width, fullRounds, partialRounds int) *grainLFSR {
+	g := &grainLFSR{}
+	pos := 0
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			g.state[pos] = byte(value>>i) & 1
+			pos++
+		}
+	}
+	appendBits(1, 2) // Prime field.
+	appendBits(0, 4) // S-box x^alpha.
+	appendBits(fieldBits, 12)
+	appendBits(width, 12)
+	appendBits(fullRounds, 10)
+	appendBits(partialRounds, 10)
+	appendBits(1<<30-1, 30)
+
+	for i := 0; i < 160; i++ {
+		g.update()
+	}
+	return g
+}
+
+func (g *grainLFSR) update() byte {
+	bit := g.state[62] ^ g.state[51] ^ g.state[38] ^ g.state[23] ^ g.state[13] ^ g.state[0]
+	copy(g.state[:], g.state[1:])
+	g.state[79] = bit
+	return bit
+}
+
+// nextBit returns the second bit of each pair of bits whose first bit is 1.
+func (g *grainLFSR) nextBit() byte {
+	for g.update() == 0 {
+		g.update()
+	}
+	return g.update()
+}
+
+// nextInt reads an integer of n bits, most significant bit first.
+func (g *grainLFSR) nextInt(n int) *big.Int {
+	x := new(big.Int)
+	for i := 0; i < n; i++ {
+		x.Lsh(x, 1)
+		if g.nextBit() == 1 {
+			x.SetBit(x, 0, 1)
+		}
+	}
+	return x
+}
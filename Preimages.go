@@ -0,0 +1,57 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// WithPreimages stores the key of each path in a MapDb, so that the keys of the leaves can be
+// found with KeyOf. Keys are added by updates and removed by deletions, unless orphans are kept,
+// as past roots may still hold the deleted keys. The tree works the same without it.
+func WithPreimages(preimages MapDb) Option {
+	return func(tree *SparseMerkleTree) {
+		tree.preimages = preimages
+	}
+}
+
+// KeyOf gets the key whose path is given, from the preimage store of the tree.
+func (smt *SparseMerkleTree) KeyOf(path []byte) ([]byte, error) {
+	if smt.preimages == nil {
+		return nil, errors.New("tree has no preimage store")
+	}
+	return smt.preimages.Get(path)
+}
+
+// setPreimage stores the key of a path, if the tree has a preimage store.
+func (smt *SparseMerkleTree) setPreimage(path, key []byte) error {
+	if smt.preimages == nil {
+		return nil
+	}
+	return smt.preimages.Set(path, key)
+}
+
+// checkCollision returns a KeyCollision error if the path of a key holds the latest value of
+// another key, which is only known if the paths are truncated hashes and the tree has a preimage store.
+func (smt *SparseMerkleTree) checkCollision(path, key []byte) error {
+	if !smt.st.truncatesHashes() || smt.preimages == nil {
+		return nil
+	}
+	other, err := getIfExists(smt.preimages, path)
+	if err != nil || other == nil || bytes.Equal(other, key) {
+		return err
+	}
+	// The key of a deleted path may be kept, for past roots.
+	value, err := getIfExists(smt.values, path)
+	if err != nil || value == nil {
+		return err
+	}
+	return &KeyCollision{Key: key, Other: other}
+}
+
+// clearPreimage removes the key of a deleted path, if the tree has a preimage store.
+func (smt *SparseMerkleTree) clearPreimage(path []byte) error {
+	if smt.preimages == nil || smt.keepOrphans || smt.refCounted {
+		return nil
+	}
+	return deleteIfExists(smt.preimages, path)
+}
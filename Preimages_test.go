@@ -0,0 +1,81 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+)
+
+func TestPreimages(t *testing.T) {
+	for _, extra := range [][]Option{nil, {WithDeferredWrites()}} {
+		preimages := NewMap()
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), append([]Option{WithPreimages(preimages)}, extra...)...)
+		var keys, values [][]byte
+		for i := 0; i < 100; i++ {
+			keys = append(keys, []byte(fmt.Sprint("key", i)))
+			values = append(values, []byte(fmt.Sprint("value", i)))
+		}
+		smt.UpdateBatch(keys[:50], values[:50])
+		for i := 50; i < 100; i++ {
+			smt.Update(keys[i], values[i])
+		}
+		smt.Delete(keys[3])
+		smt.UpdateBatch([][]byte{keys[4]}, [][]byte{DefaultVal})
+		if err := smt.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(mapEntries(preimages)); n != 98 {
+			t.Fatalf("%d preimages, want 98", n)
+		}
+
+		// Iterate returns the key of each leaf.
+		count := 0
+		err := smt.Iterate(smt.Root(), nil, func(path, key, _, value []byte) error {
+			if keyPath, _ := smt.st.path(key); !bytes.Equal(keyPath, path) {
+				t.Fatalf("leaf %x has key %q", path, key)
+			}
+			if stored, err := smt.KeyOf(path); err != nil || !bytes.Equal(stored, key) {
+				t.Fatalf("KeyOf(%x) = %q, %v", path, stored, err)
+			}
+			if want := "value" + string(key[len("key"):]); string(value) != want {
+				t.Fatalf("key %q holds %q", key, value)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 98 {
+			t.Fatalf("iterated %d leaves, want 98", count)
+		}
+
+		// A migration reads the keys from the preimage store.
+		signingKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+		migrated, _, err := smt.MigrateHasher(NewMap(), NewMap(), NewKeccak256Hasher(), nil, signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := migrated.Get(keys[7]); !bytes.Equal(value, values[7]) {
+			t.Fatalf("migrated key7 reads %q", value)
+		}
+	}
+}
+
+func TestIterateWithoutPreimages(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	smt.Update([]byte("key"), []byte("value"))
+	err := smt.Iterate(smt.Root(), nil, func(_, key, _, _ []byte) error {
+		if key != nil {
+			t.Fatalf("leaf has key %q without a preimage store", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smt.KeyOf(smt.st.EmptyPlace()); err == nil {
+		t.Fatal("KeyOf succeeded without a preimage store")
+	}
+}
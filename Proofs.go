@@ -0,0 +1,263 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// SparseMerkleProof is a Merkle proof for an element in a SparseMerkleTree.
+type SparseMerkleProof struct {
+	// SideNodes is an array of the sibling nodes leading up to the leaf of the proof, ordered from the leaf to the root.
+	SideNodes [][]byte
+
+	// NonMembershipLeafData is the data of the unrelated leaf at the position
+	// of the key being proven, in the case of a non-membership proof.
+	// For membership proofs, it is nil.
+	NonMembershipLeafData []byte
+
+	// SiblingData is the data of the sibling node to the leaf being proven, if any.
+	SiblingData []byte
+}
+
+// sanityCheck checks that the sizes of the proof fields are consistent with the hasher.
+func (proof *SparseMerkleProof) sanityCheck(st *SmtHasher) error {
+	// Do a basic sanity check on the proof, so that a malicious proof cannot
+	// cause the verifier to fatally exit (e.g. due to an index out-of-range
+	// error) or cause a CPU DoS attack.
+
+	// Check that the number of supplied sideNodes does not exceed the maximum possible.
+	if len(proof.SideNodes) > st.depth {
+		return errors.New("too many side nodes")
+	}
+
+	// Check that leaf data for non-membership proofs is the correct size.
+	if proof.NonMembershipLeafData != nil && len(proof.NonMembershipLeafData) != len(leafPrefix)+st.pathSize()*2 {
+		return errors.New("invalid non-membership leaf data")
+	}
+
+	// Check that all supplied sideNodes are the correct size.
+	for _, sideNode := range proof.SideNodes {
+		if len(sideNode) != st.pathSize() {
+			return errors.New("invalid side node size")
+		}
+	}
+
+	// Check that the sibling data hashes to the first side node if not nil.
+	if proof.SiblingData == nil || len(proof.SideNodes) == 0 {
+		return nil
+	}
+	if len(proof.SiblingData) != len(nodePrefix)+st.pathSize()*2 {
+		return errors.New("invalid sibling data")
+	}
+	siblingHash := st.digestData(proof.SiblingData)
+	if !bytes.Equal(proof.SideNodes[0], siblingHash) {
+		return errors.New("sibling data does not match the first side node")
+	}
+
+	return nil
+}
+
+// Prove generates a Merkle proof for a key against the current root.
+// The proof includes the sibling data, so it can also be used to compute the
+// root after the key is updated (see UpdateRootWithProof).
+func (smt *SparseMerkleTree) Prove(key []byte) (SparseMerkleProof, error) {
+	return smt.ProveAt(key, smt.Root())
+}
+
+// ProveAt generates a Merkle proof for a key against a specific root.
+func (smt *SparseMerkleTree) ProveAt(key, root []byte) (SparseMerkleProof, error) {
+	path, err := smt.st.path(key)
+	if err != nil {
+		return SparseMerkleProof{}, err
+	}
+	sideNodes, pathNodes, leafData, siblingData, err := smt.sideNodesForRoot(path, root, true)
+	if err != nil {
+		return SparseMerkleProof{}, err
+	}
+
+	// Deal with non-membership proofs. If the leaf hash is the EmptyPlace
+	// value, we do not need to add anything else to the proof.
+	var nonMembershipLeafData []byte
+	if !bytes.Equal(pathNodes[0], smt.st.EmptyPlace()) {
+		actualPath, _ := smt.st.parseLeaf(leafData)
+		if !bytes.Equal(actualPath, path) {
+			// This is a non-membership proof that involves showing a different leaf.
+			// Add the leaf data to the proof.
+			nonMembershipLeafData = leafData
+		}
+	}
+
+	return SparseMerkleProof{
+		SideNodes:             sideNodes,
+		NonMembershipLeafData: nonMembershipLeafData,
+		SiblingData:           siblingData,
+	}, nil
+}
+
+// VerifyProof verifies a Merkle proof for a key and value against a root.
+// A DefaultVal value verifies that the key is not present in the tree.
+// The options must be those of the tree, as they determine the path of the key.
+func VerifyProof(proof SparseMerkleProof, root []byte, key, value []byte, hasher TreeHasher, opts ...Option) bool {
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return false
+	}
+	path, err := st.path(key)
+	if err != nil {
+		return false
+	}
+
+	if err := proof.sanityCheck(st); err != nil {
+		return false
+	}
+
+	// Determine what the leaf hash should be.
+	var currentHash []byte
+	if bytes.Equal(value, DefaultVal) {
+		// Non-membership proof.
+		if proof.NonMembershipLeafData == nil {
+			// Leaf is a EmptyPlace.
+			currentHash = st.EmptyPlace()
+		} else {
+			// Leaf is an unrelated leaf.
+			actualPath, valueHash := st.parseLeaf(proof.NonMembershipLeafData)
+			if bytes.Equal(actualPath, path) {
+				// This is not an unrelated leaf; non-membership proof failed.
+				return false
+			}
+			currentHash, _ = st.digestLeaf(actualPath, valueHash)
+		}
+	} else {
+		// Membership proof.
+		valueHash := st.digest(value)
+		currentHash, _ = st.digestLeaf(path, valueHash)
+	}
+
+	// Recompute root.
+	for i, sideNode := range proof.SideNodes {
+		if getBitFromMSB(path, len(proof.SideNodes)-1-i) == right {
+			currentHash, _ = st.digestNode(sideNode, currentHash)
+		} else {
+			currentHash, _ = st.digestNode(currentHash, sideNode)
+		}
+	}
+
+	return bytes.Equal(currentHash, root)
+}
+
+// SparseCompactMerkleProof is a compact Merkle proof for an element in a SparseMerkleTree.
+type SparseCompactMerkleProof struct {
+	// SideNodes is an array of the non-EmptyPlace sibling nodes leading up to the leaf of the proof.
+	SideNodes [][]byte
+
+	// NonMembershipLeafData is the data of the unrelated leaf at the position
+	// of the key being proven, in the case of a non-membership proof.
+	// For membership proofs, it is nil.
+	NonMembershipLeafData []byte
+
+	// BitMask is a bit mask of the sidenodes of the proof where an on-bit
+	// indicates that the sidenode at the bit's index is a EmptyPlace.
+	BitMask []byte
+
+	// NumSideNodes indicates the number of sidenodes in the proof when decompacted.
+	NumSideNodes int
+
+	// SiblingData is the data of the sibling node to the leaf being proven, if any.
+	SiblingData []byte
+}
+
+// sanityCheck checks that the sizes of the compact proof fields are consistent with the hasher.
+func (proof *SparseCompactMerkleProof) sanityCheck(st *SmtHasher) error {
+	// Do a basic sanity check on the proof on the fields of the proof specific to
+	// the compact proof only.
+	//
+	// When the proof is de-compacted and verified, the sanity check for the
+	// de-compacted proof should be executed.
+
+	// Check that NumSideNodes is within the right range.
+	if proof.NumSideNodes < 0 || proof.NumSideNodes > st.depth {
+		return errors.New("invalid number of side nodes")
+	}
+
+	// Check that the length of the bit mask is as expected
+	// according to NumSideNodes.
+	if len(proof.BitMask) != (proof.NumSideNodes+7)/8 {
+		return errors.New("invalid bit mask length")
+	}
+
+	// Check that the correct number of sidenodes have been
+	// supplied according to the bit mask.
+	if len(proof.SideNodes) != proof.NumSideNodes-countSetBits(proof.BitMask) {
+		return errors.New("side nodes do not match the bit mask")
+	}
+
+	return nil
+}
+
+// CompactProof compacts a proof, to reduce its size.
+func CompactProof(proof SparseMerkleProof, hasher TreeHasher, opts ...Option) (SparseCompactMerkleProof, error) {
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return SparseCompactMerkleProof{}, err
+	}
+
+	if err := proof.sanityCheck(st); err != nil {
+		return SparseCompactMerkleProof{}, err
+	}
+
+	bitMask := emptyBytes((len(proof.SideNodes) + 7) / 8)
+	var compactedSideNodes [][]byte
+	for i, sideNode := range proof.SideNodes {
+		if bytes.Equal(sideNode, st.EmptyPlace()) {
+			setBitFromMSB(bitMask, i)
+		} else {
+			compactedSideNodes = append(compactedSideNodes, sideNode)
+		}
+	}
+
+	return SparseCompactMerkleProof{
+		SideNodes:             compactedSideNodes,
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		BitMask:               bitMask,
+		NumSideNodes:          len(proof.SideNodes),
+		SiblingData:           proof.SiblingData,
+	}, nil
+}
+
+// DecompactProof decompacts a proof, so that it can be used for VerifyProof.
+func DecompactProof(proof SparseCompactMerkleProof, hasher TreeHasher, opts ...Option) (SparseMerkleProof, error) {
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return SparseMerkleProof{}, err
+	}
+
+	if err := proof.sanityCheck(st); err != nil {
+		return SparseMerkleProof{}, err
+	}
+
+	decompactedSideNodes := make([][]byte, proof.NumSideNodes)
+	position := 0
+	for i := 0; i < proof.NumSideNodes; i++ {
+		if getBitFromMSB(proof.BitMask, i) == 1 {
+			decompactedSideNodes[i] = st.EmptyPlace()
+		} else {
+			decompactedSideNodes[i] = proof.SideNodes[position]
+			position++
+		}
+	}
+
+	return SparseMerkleProof{
+		SideNodes:             decompactedSideNodes,
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		SiblingData:           proof.SiblingData,
+	}, nil
+}
+
+// VerifyCompactProof verifies a compacted Merkle proof for a key and value against a root.
+func VerifyCompactProof(proof SparseCompactMerkleProof, root []byte, key, value []byte, hasher TreeHasher, opts ...Option) bool {
+	decompactedProof, err := DecompactProof(proof, hasher, opts...)
+	if err != nil {
+		return false
+	}
+	return VerifyProof(decompactedProof, root, key, value, hasher, opts...)
+}
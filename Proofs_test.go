@@ -0,0 +1,168 @@
+package smt
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestProveAndVerifyProof(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	model := make(map[string][]byte)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprint("key", rng.Intn(100)))
+		if rng.Intn(4) == 0 {
+			if _, err := smt.Delete(key); err != nil {
+				t.Fatalf("delete %s: %v", key, err)
+			}
+			delete(model, string(key))
+		} else {
+			value := []byte(fmt.Sprint("value", i))
+			if _, err := smt.Update(key, value); err != nil {
+				t.Fatalf("update %s: %v", key, err)
+			}
+			model[string(key)] = value
+		}
+		if i%10 != 0 {
+			continue
+		}
+
+		root := smt.Root()
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprint("key", j))
+			proof, err := smt.Prove(key)
+			if err != nil {
+				t.Fatalf("prove %s: %v", key, err)
+			}
+			value := model[string(key)]
+			if !VerifyProof(proof, root, key, value, NewSHA256Hasher()) {
+				t.Fatalf("proof of %s does not verify", key)
+			}
+			if VerifyProof(proof, root, key, []byte("wrong"), NewSHA256Hasher()) {
+				t.Fatalf("proof of %s verifies a wrong value", key)
+			}
+			if value != nil && VerifyProof(proof, root, key, DefaultVal, NewSHA256Hasher()) {
+				t.Fatalf("proof of %s verifies non-membership of a present key", key)
+			}
+		}
+	}
+}
+
+func TestVerifyProofRejectsMalformedProofs(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 20; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	proof, err := smt.Prove([]byte("key3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := smt.Root()
+
+	tooMany := proof
+	tooMany.SideNodes = make([][]byte, 257)
+	for i := range tooMany.SideNodes {
+		tooMany.SideNodes[i] = make([]byte, 32)
+	}
+	shortSide := proof
+	shortSide.SideNodes = append([][]byte{[]byte("short")}, proof.SideNodes[1:]...)
+	badSibling := proof
+	badSibling.SiblingData = append([]byte{}, proof.SiblingData...)
+	badSibling.SiblingData[len(badSibling.SiblingData)-1] ^= 1
+
+	for name, bad := range map[string]SparseMerkleProof{
+		"too many side nodes": tooMany,
+		"short side node":     shortSide,
+		"bad sibling data":    badSibling,
+	} {
+		if VerifyProof(bad, root, []byte("key3"), []byte("value3"), NewSHA256Hasher()) {
+			t.Errorf("%s: proof verifies", name)
+		}
+	}
+}
+
+func TestCompactProof(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 200; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	root := smt.Root()
+	elided := 0
+	for i := 0; i < 250; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := DefaultVal
+		if i < 200 {
+			value = []byte(fmt.Sprint("value", i))
+		}
+		proof, err := smt.Prove(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, err := CompactProof(proof, NewSHA256Hasher())
+		if err != nil {
+			t.Fatalf("compact %s: %v", key, err)
+		}
+		placeholders := 0
+		for _, sideNode := range proof.SideNodes {
+			if string(sideNode) == string(smt.st.EmptyPlace()) {
+				placeholders++
+			}
+		}
+		if len(compact.SideNodes) != len(proof.SideNodes)-placeholders {
+			t.Fatalf("compact proof of %s keeps %d of %d side nodes, with %d placeholders", key, len(compact.SideNodes), len(proof.SideNodes), placeholders)
+		}
+		elided += placeholders
+		if !VerifyCompactProof(compact, root, key, value, NewSHA256Hasher()) {
+			t.Fatalf("compact proof of %s does not verify", key)
+		}
+		if VerifyCompactProof(compact, root, key, []byte("wrong"), NewSHA256Hasher()) {
+			t.Fatalf("compact proof of %s verifies a wrong value", key)
+		}
+
+		decompacted, err := DecompactProof(compact, NewSHA256Hasher())
+		if err != nil {
+			t.Fatalf("decompact %s: %v", key, err)
+		}
+		if len(decompacted.SideNodes) != len(proof.SideNodes) {
+			t.Fatalf("decompacted proof of %s has %d side nodes, want %d", key, len(decompacted.SideNodes), len(proof.SideNodes))
+		}
+		for j := range proof.SideNodes {
+			if string(decompacted.SideNodes[j]) != string(proof.SideNodes[j]) {
+				t.Fatalf("decompacted side node %d of %s differs", j, key)
+			}
+		}
+	}
+	if elided == 0 {
+		t.Fatal("no placeholder was elided")
+	}
+}
+
+func TestDecompactProofRejectsMalformedProofs(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 20; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	proof, _ := smt.Prove([]byte("key3"))
+	compact, err := CompactProof(proof, NewSHA256Hasher())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badCount := compact
+	badCount.NumSideNodes = 300
+	badMask := compact
+	badMask.BitMask = append(append([]byte{}, compact.BitMask...), 0)
+	missingSide := compact
+	missingSide.SideNodes = compact.SideNodes[1:]
+
+	for name, bad := range map[string]SparseCompactMerkleProof{
+		"too many side nodes": badCount,
+		"long bit mask":       badMask,
+		"missing side node":   missingSide,
+	} {
+		if _, err := DecompactProof(bad, NewSHA256Hasher()); err == nil {
+			t.Errorf("%s: decompacted", name)
+		}
+	}
+}
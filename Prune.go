@@ -0,0 +1,101 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// PruneResult reports what Prune reclaimed.
+type PruneResult struct {
+	Nodes int // Nodes is the number of nodes removed from the nodes MapDb.
+	Bytes int // Bytes is the size of the keys and data removed from the nodes and values MapDbs.
+}
+
+// Prune removes every node that is not reachable from one of the retained roots or from a live
+// snapshot, together with the values stored under its leaves. It is meant for trees that retain
+// orphans, whose nodes MapDb otherwise grows without bound. The nodes MapDb must be an IterableMapDb.
+// Trees that count references free their nodes as they are orphaned, and cannot be pruned.
+func (smt *SparseMerkleTree) Prune(retainedRoots [][]byte) (PruneResult, error) {
+	if smt.refCounted {
+		return PruneResult{}, errors.New("tree counts references and cannot be pruned")
+	}
+	if err := smt.checkHasher(); err != nil {
+		return PruneResult{}, err
+	}
+	nodes, ok := smt.nodes.(IterableMapDb)
+	if !ok {
+		return PruneResult{}, errors.New("nodes MapDb cannot be iterated")
+	}
+
+	// Mark.
+	marked := make(map[string]bool)
+	// The roots of live snapshots are retained as well.
+	for _, root := range append(append([][]byte{}, retainedRoots...), smt.pinnedRoots()...) {
+		if err := smt.markReachable(root, marked); err != nil {
+			return PruneResult{}, err
+		}
+	}
+
+	// Sweep. Unreachable nodes are collected first, as not every MapDb
+	// supports deleting entries while it is being iterated.
+	var unreachable, unreachableLeaves [][]byte
+	var result PruneResult
+	err := nodes.Iterate(func(key, value []byte) error {
+		if marked[string(key)] || bytes.HasPrefix(key, metaKeyPrefix) {
+			return nil
+		}
+		unreachable = append(unreachable, key)
+		if smt.st.isLeaf(value) {
+			unreachableLeaves = append(unreachableLeaves, key)
+		}
+		result.Nodes++
+		result.Bytes += len(key) + len(value)
+		return nil
+	})
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	for _, key := range unreachable {
+		if err := smt.nodes.Delete(key); err != nil {
+			return PruneResult{}, err
+		}
+	}
+	for _, key := range unreachableLeaves {
+		value, err := getIfExists(smt.values, key)
+		if err != nil {
+			return PruneResult{}, err
+		}
+		if value == nil {
+			continue
+		}
+		if err := smt.values.Delete(key); err != nil {
+			return PruneResult{}, err
+		}
+		result.Bytes += len(key) + len(value)
+	}
+
+	return result, nil
+}
+
+// markReachable marks every node reachable from a root.
+// Subtrees whose root is already marked are not walked again.
+func (smt *SparseMerkleTree) markReachable(root []byte, marked map[string]bool) error {
+	if bytes.Equal(root, smt.st.EmptyPlace()) || marked[string(root)] {
+		return nil
+	}
+	data, err := smt.nodes.Get(root)
+	if err != nil {
+		return err
+	}
+	marked[string(root)] = true
+	if smt.st.isLeaf(data) {
+		return nil
+	}
+
+	leftNode, rightNode := smt.st.parseNode(data)
+	if err := smt.markReachable(leftNode, marked); err != nil {
+		return err
+	}
+	return smt.markReachable(rightNode, marked)
+}
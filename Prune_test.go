@@ -0,0 +1,70 @@
+package smt
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	vt, err := NewVersionedSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := versionedWorkload(t, vt, rand.New(rand.NewSource(8)), 10, 50, 60)
+	// Updates after the last commit orphan nodes that belong to no version.
+	vt.Update([]byte("key0"), []byte("uncommitted"))
+	vt.Update([]byte("key0"), []byte("uncommitted again"))
+	for _, version := range []uint64{2, 4, 6, 8} {
+		if err := vt.DeleteVersion(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := len(mapEntries(nodes))
+	retained, err := vt.RetainedRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := vt.Prune(retained)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Nodes == 0 || result.Bytes == 0 {
+		t.Fatalf("nothing was pruned: %+v", result)
+	}
+	if after := len(mapEntries(nodes)); before-after != result.Nodes {
+		t.Fatalf("pruned %d nodes, reported %d", before-after, result.Nodes)
+	}
+	checkVersions(t, vt, models, 60)
+	if value, _ := vt.Get([]byte("key0")); string(value) != "uncommitted again" {
+		t.Fatalf("current value of key0 is %q", value)
+	}
+	if result, _ := vt.Prune(retained); result.Nodes != 0 {
+		t.Fatalf("second prune removed %d nodes", result.Nodes)
+	}
+
+	// Pruning down to the current root leaves the nodes and values of a tree built afresh.
+	if _, err := vt.Prune([][]byte{vt.Root()}); err != nil {
+		t.Fatal(err)
+	}
+	freshNodes, freshValues := NewMap(), NewMap()
+	fresh := NewSparseMerkleTree(freshNodes, freshValues, NewSHA256Hasher())
+	for key, value := range models[10] {
+		fresh.Update([]byte(key), []byte(value))
+	}
+	fresh.Update([]byte("key0"), []byte("uncommitted again"))
+	if string(fresh.Root()) != string(vt.Root()) {
+		t.Fatal("pruned tree has another root than a fresh tree")
+	}
+	sameEntries(t, "nodes", nodes, freshNodes)
+	sameEntries(t, "values", values, freshValues)
+}
+
+func TestPruneRefusesReferenceCountedTrees(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithReferenceCounting())
+	smt.Update([]byte("key"), []byte("value"))
+	if _, err := smt.Prune([][]byte{smt.Root()}); err == nil {
+		t.Fatal("reference-counted tree was pruned")
+	}
+}
@@ -0,0 +1,322 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// RangeLeaf is a leaf whose path is in the range of a range proof.
+type RangeLeaf struct {
+	Path []byte
+	// Key is the key of the path, if the tree has a preimage store that holds it, and nil otherwise.
+	Key   []byte
+	Value []byte
+}
+
+// SparseMerkleRangeProof is a Merkle proof of all of the leaves of a SparseMerkleTree whose paths
+// are in a range. It shows that no leaf in the range was left out.
+type SparseMerkleRangeProof struct {
+	// Flags is a bit mask with one bit per node visited by a depth-first, left-to-right walk from
+	// the root into the subtrees that overlap the range, where an on-bit indicates that the walk
+	// descends into the node and an off-bit indicates that the node is a leaf or a EmptyPlace.
+	Flags []byte
+
+	// SideNodes are the roots of the subtrees next to the walk that lie entirely outside the range,
+	// on its left and right boundaries, in the order the walk visits them.
+	SideNodes [][]byte
+
+	// LeafData has one entry per leaf or EmptyPlace reached by the walk, holding the data of the
+	// leaf, or nil for a EmptyPlace. It includes the leaves outside the range at its boundaries.
+	LeafData [][]byte
+}
+
+// sanityCheck checks that the sizes of the range proof fields are consistent with the hasher.
+func (proof *SparseMerkleRangeProof) sanityCheck(st *SmtHasher) error {
+	for _, sideNode := range proof.SideNodes {
+		if len(sideNode) != st.pathSize() {
+			return errors.New("invalid side node size")
+		}
+	}
+	for _, leafData := range proof.LeafData {
+		if leafData != nil && len(leafData) != len(leafPrefix)+st.pathSize()*2 {
+			return errors.New("invalid leaf data")
+		}
+	}
+	return nil
+}
+
+// ProveRange returns the leaves of the tree at the given root whose paths are between start and
+// end inclusive, in path order, together with a proof that they are all of the leaves in that range.
+func (smt *SparseMerkleTree) ProveRange(root, start, end []byte) ([]RangeLeaf, SparseMerkleRangeProof, error) {
+	if len(start) != smt.st.pathSize() || len(end) != smt.st.pathSize() {
+		return nil, SparseMerkleRangeProof{}, errors.New("invalid path size")
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, SparseMerkleRangeProof{}, errors.New("start of range is after its end")
+	}
+
+	b := rangeProofBuilder{smt: smt, bounds: newRangeBounds(&smt.st, start, end)}
+	if err := b.walk(root, 0); err != nil {
+		return nil, SparseMerkleRangeProof{}, err
+	}
+	return b.leaves, SparseMerkleRangeProof{
+		Flags:     b.flags,
+		SideNodes: b.sideNodes,
+		LeafData:  b.leafData,
+	}, nil
+}
+
+// rangeBounds tells which subtrees overlap a range of paths.
+type rangeBounds struct {
+	st         *SmtHasher
+	start, end []byte
+	// prefix holds the path bits of the node being visited.
+	prefix []byte
+}
+
+func newRangeBounds(st *SmtHasher, start, end []byte) *rangeBounds {
+	return &rangeBounds{st: st, start: start, end: end, prefix: emptyBytes(st.pathSize())}
+}
+
+// setBit sets the bit of the prefix at the given depth for the child being visited.
+func (r *rangeBounds) setBit(depth, bit int) {
+	if bit == right {
+		setBitFromMSB(r.prefix, depth)
+	} else {
+		r.prefix[depth/8] &^= 1 << (8 - 1 - uint(depth)%8)
+	}
+}
+
+// overlaps tells whether the subtree at the given depth under the prefix has paths in the range.
+func (r *rangeBounds) overlaps(depth int) bool {
+	first := emptyBytes(len(r.prefix))
+	last := emptyBytes(len(r.prefix))
+	for i := 0; i < r.st.depth; i++ {
+		if i < depth && getBitFromMSB(r.prefix, i) == 1 {
+			setBitFromMSB(first, i)
+			setBitFromMSB(last, i)
+		} else if i >= depth {
+			setBitFromMSB(last, i)
+		}
+	}
+	return bytes.Compare(first, r.end) <= 0 && bytes.Compare(last, r.start) >= 0
+}
+
+// contains tells whether a path is in the range.
+func (r *rangeBounds) contains(path []byte) bool {
+	return bytes.Compare(path, r.start) >= 0 && bytes.Compare(path, r.end) <= 0
+}
+
+// underPrefix tells whether a path is in the subtree at the given depth under the prefix.
+func (r *rangeBounds) underPrefix(path []byte, depth int) bool {
+	return countCommonPrefix(path, r.prefix, depth) == depth
+}
+
+// rangeProofBuilder accumulates the fields of a range proof during the walk.
+type rangeProofBuilder struct {
+	smt       *SparseMerkleTree
+	bounds    *rangeBounds
+	flags     []byte
+	numFlags  int
+	sideNodes [][]byte
+	leafData  [][]byte
+	leaves    []RangeLeaf
+}
+
+func (b *rangeProofBuilder) addFlag(descend bool) {
+	if b.numFlags%8 == 0 {
+		b.flags = append(b.flags, 0)
+	}
+	if descend {
+		setBitFromMSB(b.flags, b.numFlags)
+	}
+	b.numFlags++
+}
+
+// walk visits the node at the given depth, whose subtree overlaps the range.
+func (b *rangeProofBuilder) walk(nodeHash []byte, depth int) error {
+	st := &b.smt.st
+	if bytes.Equal(nodeHash, st.EmptyPlace()) {
+		b.addFlag(false)
+		b.leafData = append(b.leafData, nil)
+		return nil
+	}
+
+	nodeData, err := b.smt.nodes.Get(nodeHash)
+	if err != nil {
+		return err
+	}
+	if st.isLeaf(nodeData) {
+		b.addFlag(false)
+		b.leafData = append(b.leafData, nodeData)
+		path, valueHash := st.parseLeaf(nodeData)
+		if !b.bounds.contains(path) {
+			return nil
+		}
+		value, err := b.smt.leafValue(nodeHash, path, valueHash)
+		if err != nil {
+			return err
+		}
+		leaf := RangeLeaf{Path: path, Value: value}
+		if b.smt.preimages != nil {
+			if leaf.Key, err = getIfExists(b.smt.preimages, path); err != nil {
+				return err
+			}
+		}
+		b.leaves = append(b.leaves, leaf)
+		return nil
+	}
+	if depth >= b.smt.depth() {
+		return errors.New("node is deeper than the tree")
+	}
+
+	b.addFlag(true)
+	leftNode, rightNode := st.parseNode(nodeData)
+	for bit, child := range [][]byte{leftNode, rightNode} {
+		b.bounds.setBit(depth, bit)
+		if !b.bounds.overlaps(depth + 1) {
+			b.sideNodes = append(b.sideNodes, child)
+			continue
+		}
+		if err := b.walk(child, depth+1); err != nil {
+			return err
+		}
+	}
+	b.bounds.setBit(depth, 0)
+	return nil
+}
+
+// VerifyRangeProof verifies that the leaves are all of the leaves whose paths are between start
+// and end inclusive in the tree with the given root. The leaves must be in path order, and only
+// their paths and values are checked. The options must be those of the tree.
+func VerifyRangeProof(proof SparseMerkleRangeProof, root, start, end []byte, leaves []RangeLeaf, hasher TreeHasher, opts ...Option) bool {
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return false
+	}
+	_, ok := verifyRangeProof(st, proof, root, start, end, leaves, false)
+	return ok
+}
+
+// verifyRangeProof verifies a range proof, and returns the nodes it recomputes if record is set.
+func verifyRangeProof(st *SmtHasher, proof SparseMerkleRangeProof, root, start, end []byte, leaves []RangeLeaf, record bool) ([]proofNode, bool) {
+	if len(start) != st.pathSize() || len(end) != st.pathSize() || bytes.Compare(start, end) > 0 {
+		return nil, false
+	}
+	if err := proof.sanityCheck(st); err != nil {
+		return nil, false
+	}
+
+	v := rangeProofVerifier{st: st, proof: &proof, bounds: newRangeBounds(st, start, end), leaves: leaves, record: record}
+	currentHash, ok := v.walk(0)
+	if !ok {
+		return nil, false
+	}
+
+	// The whole proof and all of the leaves must have been consumed.
+	if len(proof.Flags) != (v.flagPos+7)/8 || v.sideNodePos != len(proof.SideNodes) || v.leafDataPos != len(proof.LeafData) || v.leafPos != len(leaves) {
+		return nil, false
+	}
+	return v.nodes, bytes.Equal(currentHash, root)
+}
+
+// proofNode is a node recomputed while verifying a proof.
+type proofNode struct {
+	hash []byte
+	data []byte
+}
+
+// rangeProofVerifier keeps track of the position in each field of a range proof during verification.
+type rangeProofVerifier struct {
+	st          *SmtHasher
+	proof       *SparseMerkleRangeProof
+	bounds      *rangeBounds
+	leaves      []RangeLeaf
+	flagPos     int
+	sideNodePos int
+	leafDataPos int
+	leafPos     int
+	// record makes the verifier keep the leaves and inner nodes it recomputes in nodes.
+	record bool
+	nodes  []proofNode
+}
+
+// recordNode keeps a recomputed node, if the verifier records them.
+func (v *rangeProofVerifier) recordNode(nodeHash, nodeData []byte) {
+	if v.record {
+		v.nodes = append(v.nodes, proofNode{hash: nodeHash, data: nodeData})
+	}
+}
+
+// walk recomputes the hash of the node at the given depth, whose subtree overlaps the range.
+func (v *rangeProofVerifier) walk(depth int) ([]byte, bool) {
+	if v.flagPos >= len(v.proof.Flags)*8 {
+		return nil, false
+	}
+	descend := getBitFromMSB(v.proof.Flags, v.flagPos) == 1
+	v.flagPos++
+
+	if !descend {
+		return v.terminal(depth)
+	}
+	if depth >= v.st.depth {
+		return nil, false
+	}
+
+	var children [2][]byte
+	for bit := range children {
+		v.bounds.setBit(depth, bit)
+		if !v.bounds.overlaps(depth + 1) {
+			if v.sideNodePos >= len(v.proof.SideNodes) {
+				return nil, false
+			}
+			children[bit] = v.proof.SideNodes[v.sideNodePos]
+			v.sideNodePos++
+			continue
+		}
+		child, ok := v.walk(depth + 1)
+		if !ok {
+			return nil, false
+		}
+		children[bit] = child
+	}
+	v.bounds.setBit(depth, 0)
+
+	currentHash, nodeData := v.st.digestNode(children[0], children[1])
+	v.recordNode(currentHash, nodeData)
+	return currentHash, true
+}
+
+// terminal computes the hash of a leaf or EmptyPlace reached at the given depth, and checks it
+// against the next leaf if its path is in the range.
+func (v *rangeProofVerifier) terminal(depth int) ([]byte, bool) {
+	if v.leafDataPos >= len(v.proof.LeafData) {
+		return nil, false
+	}
+	leafData := v.proof.LeafData[v.leafDataPos]
+	v.leafDataPos++
+	if leafData == nil {
+		return v.st.EmptyPlace(), true
+	}
+	if !v.st.isLeaf(leafData) {
+		return nil, false
+	}
+
+	path, valueHash := v.st.parseLeaf(leafData)
+	if !v.bounds.underPrefix(path, depth) {
+		return nil, false
+	}
+	if v.bounds.contains(path) {
+		if v.leafPos >= len(v.leaves) {
+			return nil, false
+		}
+		leaf := v.leaves[v.leafPos]
+		v.leafPos++
+		if !bytes.Equal(leaf.Path, path) || !bytes.Equal(v.st.digest(leaf.Value), valueHash) {
+			return nil, false
+		}
+	}
+	currentHash, leafData := v.st.digestLeaf(path, valueHash)
+	v.recordNode(currentHash, leafData)
+	return currentHash, true
+}
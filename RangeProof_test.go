@@ -0,0 +1,93 @@
+package smt
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestProveRangeAndVerifyRangeProof(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithDepth(64), WithRawKeys()}, {WithPreimages(NewMap())}} {
+		hasher := NewSHA256Hasher()
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), hasher, opts...)
+		rng := rand.New(rand.NewSource(9))
+		for i := 0; i < 400; i++ {
+			if _, err := smt.Update(uint64Bytes(uint64(rng.Intn(2000))), []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var paths [][]byte
+		smt.Iterate(smt.Root(), nil, func(path, _, _, _ []byte) error {
+			paths = append(paths, path)
+			return nil
+		})
+		root := smt.Root()
+
+		for trial := 0; trial < 200; trial++ {
+			start := hasher.Path([]byte{byte(trial), 1})
+			end := hasher.Path([]byte{byte(trial), 2})
+			if trial%3 == 0 {
+				// Ranges that start at a leaf.
+				start = paths[rng.Intn(len(paths))]
+			}
+			if trial%5 == 0 {
+				end = start
+			}
+			if bytes.Compare(start, end) > 0 {
+				start, end = end, start
+			}
+			leaves, proof, err := smt.ProveRange(root, start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			for _, path := range paths {
+				if bytes.Compare(path, start) >= 0 && bytes.Compare(path, end) <= 0 {
+					want++
+				}
+			}
+			if len(leaves) != want {
+				t.Fatalf("range %x-%x has %d leaves, want %d", start, end, len(leaves), want)
+			}
+			if !VerifyRangeProof(proof, root, start, end, leaves, hasher, opts...) {
+				t.Fatalf("range proof %x-%x does not verify", start, end)
+			}
+			if len(leaves) == 0 {
+				continue
+			}
+			if VerifyRangeProof(proof, root, start, end, leaves[1:], hasher, opts...) {
+				t.Fatal("range proof verifies with a leaf left out")
+			}
+			wrong := append([]RangeLeaf{}, leaves...)
+			wrong[0].Value = []byte("wrong")
+			if VerifyRangeProof(proof, root, start, end, wrong, hasher, opts...) {
+				t.Fatal("range proof verifies a wrong value")
+			}
+		}
+
+		first, last := make([]byte, 32), bytes.Repeat([]byte{0xff}, 32)
+		leaves, proof, err := smt.ProveRange(root, first, last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leaves) != len(paths) || !VerifyRangeProof(proof, root, first, last, leaves, hasher, opts...) {
+			t.Fatal("range proof of the whole tree does not verify")
+		}
+	}
+}
+
+func TestRangeProofOfEmptyTree(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	first, last := make([]byte, 32), bytes.Repeat([]byte{0xff}, 32)
+	leaves, proof, err := smt.ProveRange(smt.Root(), first, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 0 || !VerifyRangeProof(proof, smt.Root(), first, last, leaves, NewSHA256Hasher()) {
+		t.Fatal("range proof of the empty tree does not verify")
+	}
+	forged := []RangeLeaf{{Path: first, Value: []byte("value")}}
+	if VerifyRangeProof(proof, smt.Root(), first, last, forged, NewSHA256Hasher()) {
+		t.Fatal("range proof of the empty tree verifies a leaf")
+	}
+}
@@ -0,0 +1,422 @@
+package smt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reconciliation brings a tree to the root of a peer that has a similar tree. The peer serving the
+// root starts by sending the name of its hasher and the root. The peer reconciling then walks the
+// root down, and requests in batches the nodes it does not have, an identical hash meaning that
+// the whole subtree is already there. Each request is a count of hashes followed by the hashes,
+// and each response holds for every hash a kind byte followed by length-prefixed fields:
+//
+//	reconcileMissing:    nothing
+//	reconcileNode:       node data
+//	reconcileLeaf:       leaf data | value
+//	reconcileLeafWithKey leaf data | value | key
+//
+// A request with no hashes ends the session. All numbers are 4 bytes and big-endian.
+const (
+	reconcileMissing = iota
+	reconcileNode
+	reconcileLeaf
+	reconcileLeafWithKey
+)
+
+const (
+	// reconcileBatchSize is the largest number of hashes in a request.
+	reconcileBatchSize = 1024
+	// reconcileMaxField is the largest field a peer accepts.
+	reconcileMaxField = 1 << 26
+)
+
+// ReconcileStats describes a reconciliation session, to tune its use.
+type ReconcileStats struct {
+	BytesSent     int64
+	BytesReceived int64
+	// Rounds is the number of requests that were answered.
+	Rounds int
+	// Nodes is the number of inner nodes and leaves sent or received, and Leaves the number of leaves.
+	Nodes  int
+	Leaves int
+}
+
+// ServeReconcile serves the tree at the given root to a peer calling Reconcile on the other end of
+// rw, until the peer ends the session.
+func (smt *SparseMerkleTree) ServeReconcile(rw io.ReadWriter, root []byte) (ReconcileStats, error) {
+	conn := newReconcileConn(rw)
+	conn.writeField([]byte(smt.st.name()))
+	conn.writeField(root)
+	if err := conn.flush(); err != nil {
+		return conn.stats, err
+	}
+
+	for {
+		n, err := conn.readUint32()
+		if err != nil {
+			return conn.stats, err
+		}
+		if n == 0 {
+			return conn.stats, nil
+		}
+		if n > reconcileBatchSize {
+			return conn.stats, errors.New("reconciliation request is too large")
+		}
+		// The whole request is read before answering, as the peer may only read the response once
+		// it has written the request.
+		request, err := conn.read(int(n) * smt.st.pathSize())
+		if err != nil {
+			return conn.stats, err
+		}
+		for i := 0; i < len(request); i += smt.st.pathSize() {
+			if err := smt.serveNode(conn, request[i:i+smt.st.pathSize()]); err != nil {
+				return conn.stats, err
+			}
+		}
+		if err := conn.flush(); err != nil {
+			return conn.stats, err
+		}
+		conn.stats.Rounds++
+	}
+}
+
+// serveNode writes the response for a requested node.
+func (smt *SparseMerkleTree) serveNode(conn *reconcileConn, nodeHash []byte) error {
+	nodeData, err := getIfExists(smt.nodes, nodeHash)
+	if err != nil {
+		return err
+	}
+	if len(nodeData) != len(nodePrefix)+smt.st.pathSize()*2 {
+		// Metadata is not served.
+		conn.writeByte(reconcileMissing)
+		return nil
+	}
+	if !smt.st.isLeaf(nodeData) {
+		conn.writeByte(reconcileNode)
+		conn.writeField(nodeData)
+		conn.stats.Nodes++
+		return nil
+	}
+
+	path, valueHash := smt.st.parseLeaf(nodeData)
+	value, err := smt.leafValue(nodeHash, path, valueHash)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if smt.preimages != nil {
+		if key, err = getIfExists(smt.preimages, path); err != nil {
+			return err
+		}
+	}
+	if key == nil {
+		conn.writeByte(reconcileLeaf)
+	} else {
+		conn.writeByte(reconcileLeafWithKey)
+	}
+	conn.writeField(nodeData)
+	conn.writeField(value)
+	if key != nil {
+		conn.writeField(key)
+	}
+	conn.stats.Nodes++
+	conn.stats.Leaves++
+	return nil
+}
+
+// reconcileRequest is a node requested by Reconcile, at a depth of the tree.
+type reconcileRequest struct {
+	hash  []byte
+	depth int
+}
+
+// Reconcile fetches from the peer serving a root on the other end of rw the nodes and leaves that
+// the tree does not have, verifying each of them against the root, and moves the tree to the root.
+// The nodes are only written once all of them are received, children first, so that a tree
+// holding a node always holds its subtree. The nodes of the previous root are left in place, and
+// the values and keys read by path are brought to the root. A tree with an unfinished StateSync
+// cannot be reconciled until the sync is done.
+func (smt *SparseMerkleTree) Reconcile(rw io.ReadWriter) (ReconcileStats, error) {
+	conn := newReconcileConn(rw)
+	name, err := conn.readField()
+	if err != nil {
+		return conn.stats, err
+	}
+	if string(name) != smt.st.name() {
+		return conn.stats, &InvalidHasher{Stored: string(name), Hasher: smt.st.name()}
+	}
+	root, err := conn.readField()
+	if err != nil {
+		return conn.stats, err
+	}
+	if len(root) != smt.st.pathSize() {
+		return conn.stats, errors.New("invalid root size")
+	}
+	if err := smt.checkHasher(); err != nil {
+		return conn.stats, err
+	}
+	// A node that the tree holds stands for its whole subtree, unless a sync left it incomplete.
+	if err := smt.checkNoUnfinishedSync(); err != nil {
+		return conn.stats, err
+	}
+
+	var pending []reconcileRequest
+	var fetched []proofNode
+	var leaves []RangeLeaf
+	addRequest := func(nodeHash []byte, depth int) error {
+		if bytes.Equal(nodeHash, smt.st.EmptyPlace()) {
+			return nil
+		}
+		existing, err := getIfExists(smt.nodes, nodeHash)
+		if err != nil || existing != nil {
+			return err
+		}
+		pending = append(pending, reconcileRequest{hash: nodeHash, depth: depth})
+		return nil
+	}
+	if err := addRequest(root, 0); err != nil {
+		return conn.stats, err
+	}
+	err = smt.requestNodes(conn, &pending, func(request reconcileRequest, node proofNode, leaf *RangeLeaf) error {
+		fetched = append(fetched, node)
+		if leaf != nil {
+			leaves = append(leaves, *leaf)
+			return nil
+		}
+		leftNode, rightNode := smt.st.parseNode(node.data)
+		if err := addRequest(leftNode, request.depth+1); err != nil {
+			return err
+		}
+		return addRequest(rightNode, request.depth+1)
+	})
+	if err != nil {
+		return conn.stats, err
+	}
+
+	for _, leaf := range leaves {
+		leafHash, _ := smt.st.digestLeaf(leaf.Path, smt.st.digest(leaf.Value))
+		if err := smt.setLeafValue(leaf, leafHash); err != nil {
+			return conn.stats, err
+		}
+	}
+	for i := len(fetched) - 1; i >= 0; i-- {
+		if err := smt.setNode(fetched[i].hash, fetched[i].data); err != nil {
+			return conn.stats, err
+		}
+	}
+	// The leaves that the tree already held may have lost their keys when their paths were deleted,
+	// and are requested again for their keys.
+	if smt.preimages != nil {
+		received := make(map[string]bool, len(leaves))
+		for _, leaf := range leaves {
+			received[string(leaf.Path)] = true
+		}
+		err = smt.Diff(smt.Root(), root, func(diff LeafDiff) error {
+			if diff.Kind != Removed && diff.Key == nil && !received[string(diff.Path)] {
+				leafHash, _ := smt.st.digestLeaf(diff.Path, smt.st.digest(diff.NewValue))
+				pending = append(pending, reconcileRequest{hash: leafHash, depth: smt.depth()})
+			}
+			return nil
+		})
+		if err != nil {
+			return conn.stats, err
+		}
+		err = smt.requestNodes(conn, &pending, func(_ reconcileRequest, _ proofNode, leaf *RangeLeaf) error {
+			if leaf == nil || leaf.Key == nil {
+				return nil
+			}
+			return smt.setPreimage(leaf.Path, leaf.Key)
+		})
+		if err != nil {
+			return conn.stats, err
+		}
+	}
+	conn.writeUint32(0)
+	if err := conn.flush(); err != nil {
+		return conn.stats, err
+	}
+
+	if err := smt.syncLatestValues(root); err != nil {
+		return conn.stats, err
+	}
+	if err := smt.moveRoot(root); err != nil {
+		return conn.stats, err
+	}
+	smt.committedRoot = root
+	return conn.stats, nil
+}
+
+// requestNodes requests the pending nodes from the peer in batches, and calls fn with each of them
+// as it is received, until none are pending. fn may add requests.
+func (smt *SparseMerkleTree) requestNodes(conn *reconcileConn, pending *[]reconcileRequest, fn func(request reconcileRequest, node proofNode, leaf *RangeLeaf) error) error {
+	for len(*pending) > 0 {
+		batch := *pending
+		if len(batch) > reconcileBatchSize {
+			batch = batch[:reconcileBatchSize]
+		}
+		*pending = (*pending)[len(batch):]
+		conn.writeUint32(uint32(len(batch)))
+		for _, request := range batch {
+			conn.write(request.hash)
+		}
+		if err := conn.flush(); err != nil {
+			return err
+		}
+
+		for _, request := range batch {
+			node, leaf, err := smt.readReconcileNode(conn, request)
+			if err != nil {
+				return err
+			}
+			if err := fn(request, node, leaf); err != nil {
+				return err
+			}
+		}
+		conn.stats.Rounds++
+	}
+	return nil
+}
+
+// readReconcileNode reads and verifies the response for a requested node. It also returns the
+// leaf if the node is a leaf.
+func (smt *SparseMerkleTree) readReconcileNode(conn *reconcileConn, request reconcileRequest) (proofNode, *RangeLeaf, error) {
+	kind, err := conn.read(1)
+	if err != nil {
+		return proofNode{}, nil, err
+	}
+	if kind[0] == reconcileMissing || kind[0] > reconcileLeafWithKey {
+		return proofNode{}, nil, fmt.Errorf("peer did not send node %x", request.hash)
+	}
+	nodeData, err := conn.readField()
+	if err != nil {
+		return proofNode{}, nil, err
+	}
+	if len(nodeData) != len(nodePrefix)+smt.st.pathSize()*2 || smt.st.isLeaf(nodeData) != (kind[0] != reconcileNode) {
+		return proofNode{}, nil, errors.New("invalid node data")
+	}
+	if !bytes.Equal(smt.st.digestData(nodeData), request.hash) {
+		return proofNode{}, nil, fmt.Errorf("peer sent wrong data for node %x", request.hash)
+	}
+	node := proofNode{hash: request.hash, data: nodeData}
+	conn.stats.Nodes++
+	if kind[0] == reconcileNode {
+		if request.depth >= smt.depth() {
+			return proofNode{}, nil, errors.New("node is deeper than the tree")
+		}
+		return node, nil, nil
+	}
+
+	path, valueHash := smt.st.parseLeaf(nodeData)
+	leaf := RangeLeaf{Path: path}
+	if leaf.Value, err = conn.readField(); err != nil {
+		return proofNode{}, nil, err
+	}
+	if !bytes.Equal(smt.st.digest(leaf.Value), valueHash) {
+		return proofNode{}, nil, fmt.Errorf("peer sent wrong value for leaf %x", request.hash)
+	}
+	if kind[0] == reconcileLeafWithKey {
+		if leaf.Key, err = conn.readField(); err != nil {
+			return proofNode{}, nil, err
+		}
+		if err := smt.checkLeafKey(leaf); err != nil {
+			return proofNode{}, nil, err
+		}
+	}
+	conn.stats.Leaves++
+	return node, &leaf, nil
+}
+
+// reconcileConn reads and writes the messages of a reconciliation session, counting the bytes exchanged.
+type reconcileConn struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	stats ReconcileStats
+}
+
+func newReconcileConn(rw io.ReadWriter) *reconcileConn {
+	conn := &reconcileConn{}
+	conn.r = bufio.NewReader(&countingReader{r: rw, n: &conn.stats.BytesReceived})
+	conn.w = bufio.NewWriter(&countingWriter{w: rw, n: &conn.stats.BytesSent})
+	return conn
+}
+
+// Writes are buffered, and their errors are returned by flush.
+
+func (conn *reconcileConn) write(data []byte) {
+	conn.w.Write(data)
+}
+
+func (conn *reconcileConn) writeByte(b byte) {
+	conn.w.WriteByte(b)
+}
+
+func (conn *reconcileConn) writeUint32(n uint32) {
+	conn.write(uint32Bytes(n))
+}
+
+// writeField writes a byte slice prefixed with its length.
+func (conn *reconcileConn) writeField(data []byte) {
+	conn.writeUint32(uint32(len(data)))
+	conn.write(data)
+}
+
+func (conn *reconcileConn) flush() error {
+	return conn.w.Flush()
+}
+
+func (conn *reconcileConn) read(n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(conn.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (conn *reconcileConn) readUint32() (uint32, error) {
+	data, err := conn.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// readField reads a byte slice prefixed with its length.
+func (conn *reconcileConn) readField() ([]byte, error) {
+	n, err := conn.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if n > reconcileMaxField {
+		return nil, errors.New("reconciliation field is too long")
+	}
+	return conn.read(int(n))
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to a writer.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,242 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// reconcileConns returns the two ends of a connection, synchronous if tcp is false.
+func reconcileConns(t *testing.T, tcp bool) (net.Conn, net.Conn) {
+	t.Helper()
+	if !tcp {
+		return net.Pipe()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+// reconcile reconciles a tree with the root of a peer, failing the test if it does not end in time.
+func reconcile(t *testing.T, smt, peer *SparseMerkleTree, tcp bool) (ReconcileStats, ReconcileStats, error) {
+	t.Helper()
+	conn, peerConn := reconcileConns(t, tcp)
+	defer conn.Close()
+	defer peerConn.Close()
+	type result struct {
+		stats ReconcileStats
+		err   error
+	}
+	served, reconciled := make(chan result, 1), make(chan result, 1)
+	go func() {
+		stats, err := peer.ServeReconcile(peerConn, peer.Root())
+		peerConn.Close()
+		served <- result{stats, err}
+	}()
+	go func() {
+		stats, err := smt.Reconcile(conn)
+		conn.Close()
+		reconciled <- result{stats, err}
+	}()
+	var r result
+	select {
+	case r = <-reconciled:
+	case <-time.After(20 * time.Second):
+		t.Fatal("reconciliation did not end")
+	}
+	s := <-served
+	if r.err == nil && s.err != nil {
+		t.Fatalf("peer failed: %v", s.err)
+	}
+	return r.stats, s.stats, r.err
+}
+
+func TestReconcile(t *testing.T) {
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithReferenceCounting()} },
+		func() []Option { return []Option{WithPreimages(NewMap())} },
+	} {
+		for _, tcp := range []bool{false, true} {
+			name := fmt.Sprintf("%d options, tcp %v", len(opts()), tcp)
+			peerNodes, nodes := NewMap(), NewMap()
+			peer := NewSparseMerkleTree(peerNodes, NewMap(), NewSHA256Hasher(), opts()...)
+			smt := NewSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher(), opts()...)
+			for i := 0; i < 3000; i++ {
+				peer.Update(uint64Bytes(uint64(i)), []byte(fmt.Sprint("value", i)))
+				smt.Update(uint64Bytes(uint64(i)), []byte(fmt.Sprint("value", i)))
+			}
+			// The peer changes 20 leaves, deletes 5 and adds 10.
+			for i := 0; i < 20; i++ {
+				peer.Update(uint64Bytes(uint64(i*97)), []byte("changed"))
+			}
+			for i := 0; i < 5; i++ {
+				peer.Delete(uint64Bytes(uint64(i*31 + 1)))
+			}
+			for i := 0; i < 10; i++ {
+				peer.Update(uint64Bytes(uint64(100000+i)), []byte("added"))
+			}
+
+			stats, peerStats, err := reconcile(t, smt, peer, tcp)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(smt.Root(), peer.Root()) {
+				t.Fatalf("%s: tree is not at the root of the peer", name)
+			}
+			for i := 0; i < 3000; i++ {
+				want, _ := peer.Get(uint64Bytes(uint64(i)))
+				if value, err := smt.Get(uint64Bytes(uint64(i))); err != nil || !bytes.Equal(value, want) {
+					t.Fatalf("%s: leaf %d reads %q, want %q", name, i, value, want)
+				}
+			}
+			if value, _ := smt.Get(uint64Bytes(100003)); string(value) != "added" {
+				t.Fatalf("%s: added leaf reads %q", name, value)
+			}
+			if stats.BytesSent != peerStats.BytesReceived || stats.BytesReceived != peerStats.BytesSent ||
+				stats.Nodes != peerStats.Nodes || stats.Leaves != peerStats.Leaves {
+				t.Fatalf("%s: stats %+v differ from the stats of the peer %+v", name, stats, peerStats)
+			}
+			if stats.Leaves > 30 {
+				t.Fatalf("%s: received %d leaves for 30 differences", name, stats.Leaves)
+			}
+			if smt.preimages != nil {
+				path, _ := smt.st.path(uint64Bytes(100003))
+				if key, err := smt.KeyOf(path); err != nil || !bytes.Equal(key, uint64Bytes(100003)) {
+					t.Fatalf("%s: key of an added leaf %x, %v", name, key, err)
+				}
+			}
+			if smt.refCounted {
+				sameEntries(t, name+": nodes", nodes, peerNodes)
+			}
+			if _, err := smt.Update(uint64Bytes(5), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReconcileOverSynchronousTransport(t *testing.T) {
+	peer := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 5000; i++ {
+		peer.Update(uint64Bytes(uint64(i)), []byte("value"))
+	}
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	if _, _, err := reconcile(t, smt, peer, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(smt.Root(), peer.Root()) {
+		t.Fatal("tree is not at the root of the peer")
+	}
+}
+
+func TestReconcileReplacesLatestValues(t *testing.T) {
+	// The tree moves back to a root whose leaves it still holds, and only receives their keys.
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithOrphanRetention()} },
+		func() []Option { return []Option{WithPreimages(NewMap())} },
+		func() []Option { return []Option{WithReferenceCounting(), WithPreimages(NewMap())} },
+	} {
+		name := fmt.Sprintf("%d options", len(opts()))
+		peer := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), opts()...)
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), opts()...)
+		for _, values := range [][2]string{{"1", ""}, {"2", "2"}, {"", "2"}, {"1", ""}} {
+			peer.Update([]byte("key"), []byte(values[0]))
+			peer.Update([]byte("gone"), []byte(values[1]))
+			if _, _, err := reconcile(t, smt, peer, false); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if value, _ := smt.Get([]byte("key")); string(value) != "1" {
+			t.Fatalf("%s: key reads %q, want the value of the peer", name, value)
+		}
+		if value, _ := smt.Get([]byte("gone")); value != nil {
+			t.Fatalf("%s: key that is not under the root of the peer reads %q", name, value)
+		}
+		if smt.preimages != nil {
+			path, _ := smt.st.path([]byte("key"))
+			if key, err := smt.KeyOf(path); err != nil || string(key) != "key" {
+				t.Fatalf("%s: key of the path is %q, %v", name, key, err)
+			}
+		}
+	}
+}
+
+func TestReconcileRejectsWrongLeaves(t *testing.T) {
+	peer := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 50; i++ {
+		peer.Update(uint64Bytes(uint64(i)), []byte{byte(i)})
+	}
+	path, _ := peer.st.path(uint64Bytes(7))
+	leafHash, _ := peer.st.digestLeaf(path, peer.st.digest([]byte{7}))
+	peer.values.Set(path, []byte("wrong"))
+	peer.values.Set(leafHash, []byte("wrong"))
+
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	if _, _, err := reconcile(t, smt, peer, false); err == nil {
+		t.Fatal("wrong leaf was accepted")
+	}
+	if !bytes.Equal(smt.Root(), smt.st.EmptyPlace()) {
+		t.Fatal("tree moved to the root of the peer")
+	}
+	other := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA3Hasher())
+	if _, _, err := reconcile(t, other, peer, false); err == nil {
+		t.Fatal("tree reconciled with a peer using another hasher")
+	}
+}
+
+func TestReconcileAfterPartialSync(t *testing.T) {
+	src := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 200; i++ {
+		src.Update(syncKey(i), []byte("value"))
+	}
+	syncRoot := src.Root()
+	nodes := NewMap()
+	smt := NewSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher())
+	s, err := NewStateSync(smt, syncRoot, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(&flakyTransport{SyncTransport: LocalSyncTransport{src}, budget: 1}, 1); err == nil {
+		t.Fatal("interrupted sync succeeded")
+	}
+
+	// The synced chunk holds the nodes on the way to the other chunks, without their subtrees.
+	src.Update(syncKey(200), []byte("value"))
+	numNodes := len(mapEntries(nodes))
+	if _, _, err := reconcile(t, smt, src, false); err == nil {
+		t.Fatal("tree with an unfinished sync was reconciled")
+	}
+	if len(mapEntries(nodes)) != numNodes {
+		t.Fatal("tree with an unfinished sync was written")
+	}
+
+	src.Delete(syncKey(200))
+	if err := s.Run(LocalSyncTransport{src}, 2); err != nil {
+		t.Fatal(err)
+	}
+	src.Update(syncKey(200), []byte("value"))
+	if _, _, err := reconcile(t, smt, src, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 200; i++ {
+		if value, err := smt.GetAt(syncKey(i), src.Root()); err != nil || string(value) != "value" {
+			t.Fatalf("leaf %d reads %q, %v", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// refCountKeyPrefix is the prefix of the keys under which reference counts are stored in the nodes MapDb.
+var refCountKeyPrefix = []byte("smt:rc:")
+
+// WithReferenceCounting stores a reference count with every node. A node is referenced by each
+// stored node that has it as a child, by the tree for its current root, and by each committed
+// version of a VersionedSparseMerkleTree. Nodes are freed as soon as their count reaches zero,
+// so identical subtrees are stored once and orphans are removed in proportion to the change.
+// It must be used from the creation of the tree, as the counts of existing nodes are not known.
+func WithReferenceCounting() Option {
+	return func(tree *SparseMerkleTree) {
+		tree.refCounted = true
+	}
+}
+
+// setCountedNode stores a node created by an update. A new node is stored without references,
+// which are added by its parent or by the holder of the root, and adds a reference to each of its
+// children. A node that is already stored is left as it is.
+func (smt *SparseMerkleTree) setCountedNode(nodeHash, nodeData []byte) error {
+	existing, err := getIfExists(smt.nodes, nodeHash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+	if err := smt.nodes.Set(nodeHash, nodeData); err != nil {
+		return err
+	}
+	if smt.st.isLeaf(nodeData) {
+		return nil
+	}
+
+	leftNode, rightNode := smt.st.parseNode(nodeData)
+	if err := smt.retain(leftNode); err != nil {
+		return err
+	}
+	return smt.retain(rightNode)
+}
+
+// retain adds a reference to a node.
+func (smt *SparseMerkleTree) retain(nodeHash []byte) error {
+	if bytes.Equal(nodeHash, smt.st.EmptyPlace()) {
+		return nil
+	}
+	count, err := smt.refCount(nodeHash)
+	if err != nil {
+		return err
+	}
+	return smt.setRefCount(nodeHash, count+1)
+}
+
+// release removes a reference to a node. A node left without references is removed together
+// with the value stored under it if it is a leaf, and releases its children in turn.
+func (smt *SparseMerkleTree) release(nodeHash []byte) error {
+	if bytes.Equal(nodeHash, smt.st.EmptyPlace()) {
+		return nil
+	}
+	count, err := smt.refCount(nodeHash)
+	if err != nil {
+		return err
+	}
+	if count > 1 {
+		return smt.setRefCount(nodeHash, count-1)
+	}
+
+	nodeData, err := smt.nodes.Get(nodeHash)
+	if err != nil {
+		return err
+	}
+	if err := smt.setRefCount(nodeHash, 0); err != nil {
+		return err
+	}
+	if err := smt.nodes.Delete(nodeHash); err != nil {
+		return err
+	}
+	if smt.st.isLeaf(nodeData) {
+		return deleteIfExists(smt.values, nodeHash)
+	}
+
+	leftNode, rightNode := smt.st.parseNode(nodeData)
+	if err := smt.release(leftNode); err != nil {
+		return err
+	}
+	return smt.release(rightNode)
+}
+
+// refCount gets the reference count of a node.
+func (smt *SparseMerkleTree) refCount(nodeHash []byte) (uint64, error) {
+	value, err := getIfExists(smt.nodes, refCountKey(nodeHash))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// setRefCount sets the reference count of a node. A count of zero is not stored.
+func (smt *SparseMerkleTree) setRefCount(nodeHash []byte, count uint64) error {
+	if count == 0 {
+		return deleteIfExists(smt.nodes, refCountKey(nodeHash))
+	}
+	return smt.nodes.Set(refCountKey(nodeHash), uint64Bytes(count))
+}
+
+// refCountKey returns the key under which the reference count of a node is stored.
+func refCountKey(nodeHash []byte) []byte {
+	return append(append([]byte{}, refCountKeyPrefix...), nodeHash...)
+}
@@ -0,0 +1,109 @@
+package smt
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// refCounts returns the number of reference counts stored in a nodes Map.
+func refCounts(nodes *Map) int {
+	nodes.mu.RLock()
+	defer nodes.mu.RUnlock()
+	count := 0
+	for key := range nodes.m {
+		if strings.HasPrefix(key, string(refCountKeyPrefix)) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestReferenceCounting(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	smt := NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), WithReferenceCounting())
+	model := make(map[string]string)
+	rng := rand.New(rand.NewSource(9))
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint("key", rng.Intn(80))
+		if rng.Intn(3) == 0 {
+			if _, err := smt.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+		} else {
+			// Few distinct values, so that identical leaves are shared.
+			value := fmt.Sprint("value", rng.Intn(4))
+			if _, err := smt.Update([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		}
+	}
+
+	// Orphans are freed as they go, so the tree holds what a fresh tree holds.
+	freshNodes, freshValues := NewMap(), NewMap()
+	fresh := NewSparseMerkleTree(freshNodes, freshValues, NewSHA256Hasher())
+	for key, value := range model {
+		fresh.Update([]byte(key), []byte(value))
+	}
+	if string(fresh.Root()) != string(smt.Root()) {
+		t.Fatal("root differs from a fresh tree")
+	}
+	sameEntries(t, "nodes", nodes, freshNodes)
+	sameEntries(t, "values", values, freshValues)
+	if counts := refCounts(nodes); counts != len(mapEntries(nodes)) {
+		t.Fatalf("%d reference counts for %d nodes", counts, len(mapEntries(nodes)))
+	}
+
+	for key := range model {
+		smt.Delete([]byte(key))
+	}
+	if n, m, c := len(mapEntries(nodes)), len(mapEntries(values)), refCounts(nodes); n != 0 || m != 0 || c != 0 {
+		t.Fatalf("%d nodes, %d values and %d reference counts left", n, m, c)
+	}
+}
+
+func TestReferenceCountedVersionedTree(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	vt, err := NewVersionedSparseMerkleTree(nodes, values, NewSHA256Hasher(), WithReferenceCounting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := versionedWorkload(t, vt, rand.New(rand.NewSource(10)), 15, 40, 50)
+	checkVersions(t, vt, models, 50)
+	for _, version := range []uint64{1, 5, 3, 14} {
+		if err := vt.DeleteVersion(version); err != nil {
+			t.Fatal(err)
+		}
+		checkVersions(t, vt, models, 50)
+	}
+
+	// The counts survive reopening the tree.
+	vt.Update([]byte("uncommitted"), []byte("value"))
+	vt, err = NewVersionedSparseMerkleTree(nodes, values, NewSHA256Hasher(), WithReferenceCounting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := vt.Get([]byte("uncommitted")); string(value) != "value" {
+		t.Fatal("reopened tree lost its working root")
+	}
+	if err := vt.Rollback(10); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, vt, models, 50)
+
+	// Once nothing references them, every node and count is freed.
+	for _, version := range vt.Versions() {
+		if err := vt.DeleteVersion(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for j := 0; j < 50; j++ {
+		vt.Delete([]byte(fmt.Sprint("key", j)))
+	}
+	if n, c := len(mapEntries(nodes)), refCounts(nodes); n != 0 || c != 0 {
+		t.Fatalf("%d nodes and %d reference counts left", n, c)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/blake2b"
-	"hash"
 	"log"
 )
 
@@ -17,11 +16,44 @@ const (
 //DefaultVal is the empty slice of Byte
 var DefaultVal []byte
 
+// ErrKeyAlreadyEmpty is returned by DeleteNode when no leaf is found at the position of the path.
+var ErrKeyAlreadyEmpty = errors.New("key is already empty")
+
+// KeyCollision is returned when a key is set or deleted at the path of another key, as both have
+// the same truncated hash (see WithDepth).
+type KeyCollision struct {
+	Key   []byte
+	Other []byte
+}
+
+func (e *KeyCollision) Error() string {
+	return fmt.Sprintf("key %x has the path of key %x", e.Key, e.Other)
+}
+
+// ErrKeyNotFound is returned by DeleteNode when the leaf of another path is found at the position of the path.
+var ErrKeyNotFound = errors.New("key not found")
+
 //SparseMerkleTree is the struct defining sparse Merkle Tree.
 type SparseMerkleTree struct {
 	st            SmtHasher
 	values, nodes MapDb
-	root          *SparseMerkleNode
+	root          []byte
+	// keepOrphans keeps the nodes that an update orphans, so that past roots stay readable.
+	keepOrphans bool
+	// refCounted stores a reference count with every node, and frees nodes once nothing references them.
+	refCounted bool
+	// committedRoot is the root at the last Commit, which Discard resets the tree to.
+	committedRoot []byte
+	// hasherChecked is set once the hasher is known to match the one stored with the tree.
+	hasherChecked bool
+	// optionsErr is the error of invalid options, returned by the writes to the tree.
+	optionsErr error
+	// deferredWrites keeps changes in overlays on top of the MapDbs until Commit is called.
+	deferredWrites bool
+	// preimages stores the key of each path, if it is not nil.
+	preimages MapDb
+	// pins keeps the nodes of the live snapshots of the tree.
+	pins snapshotPins
 }
 
 type SparseMerkleNode struct {
@@ -51,8 +83,54 @@ func NewSparseMerkleNode(left, right *SparseMerkleNode, data []byte) *SparseMerk
 //Option is a function that configures Smt.
 type Option func(tree *SparseMerkleTree)
 
+//WithOrphanRetention keeps the nodes and values that updates orphan instead of deleting them,
+//so that every past root stays readable until its nodes are explicitly pruned.
+func WithOrphanRetention() Option {
+	return func(tree *SparseMerkleTree) {
+		tree.keepOrphans = true
+	}
+}
+
+//WithDepth sets the number of bits of the paths, from 1 to the size of the hashes in bits.
+//Only the first bits of the hashes of keys are used, so two keys may have the same path. Setting
+//one of them then fails with a KeyCollision error if the other is in the batch or, with a preimage
+//store, in the tree; without a preimage store, it replaces the other.
+//A depth out of range is reported by ValidateOptions, and by the first write to the tree.
+func WithDepth(depth int) Option {
+	return func(tree *SparseMerkleTree) {
+		tree.st.depth = depth
+	}
+}
+
+//WithRawKeys uses the keys as the paths of their leaves instead of hashing them, so that the leaves
+//are laid out in key order. Keys must be as long as the depth of the tree, rounded up to bytes.
+func WithRawKeys() Option {
+	return func(tree *SparseMerkleTree) {
+		tree.st.rawKeys = true
+	}
+}
+
+// ValidateOptions checks that options are valid for a tree with the given hasher.
+func ValidateOptions(hasher TreeHasher, opts ...Option) error {
+	_, err := proofHasher(hasher, opts)
+	return err
+}
+
+// proofHasher returns the hasher of a tree created with the given options, for the functions
+// that work on proofs without a tree.
+func proofHasher(hasher TreeHasher, opts []Option) (*SmtHasher, error) {
+	smt := SparseMerkleTree{st: *newSmtHasher(hasher)}
+	for _, opt := range opts {
+		opt(&smt)
+	}
+	if err := smt.st.checkLayout(); err != nil {
+		return nil, err
+	}
+	return &smt.st, nil
+}
+
 //NewSparseMerkleTree creates a new Sparse Merkle on an empty MapDb.
-func NewSparseMerkleTree(nodes, values MapDb, hasher hash.Hash, opts ...Option) *SparseMerkleTree {
+func NewSparseMerkleTree(nodes, values MapDb, hasher TreeHasher, opts ...Option) *SparseMerkleTree {
 	smt := SparseMerkleTree{
 		st:     *newSmtHasher(hasher),
 		nodes:  nodes,
@@ -62,25 +140,41 @@ func NewSparseMerkleTree(nodes, values MapDb, hasher hash.Hash, opts ...Option)
 	for _, opt := range opts {
 		opt(&smt)
 	}
+	if err := smt.st.checkLayout(); err != nil {
+		// The tree cannot be written, and is read with the full depth.
+		smt.optionsErr = err
+		smt.st.depth = smt.st.pathSize() * 8
+	}
+	if smt.deferredWrites {
+		smt.deferWrites()
+	}
 
-	smt.SetRoot(nil)
+	smt.SetRoot(smt.st.EmptyPlace())
+	smt.committedRoot = smt.Root()
 
 	return &smt
 }
 
-// GetRoot gets the root of the tree.
-func (smt *SparseMerkleTree) GetRoot() *SparseMerkleNode {
-	return smt.root
+//ImportSparseMerkleTree imports a Sparse Merkle tree from non-empty MapDbs, at the given root.
+//It returns an InvalidHasher error if the tree was built with another hasher.
+func ImportSparseMerkleTree(nodes, values MapDb, hasher TreeHasher, root []byte, opts ...Option) (*SparseMerkleTree, error) {
+	smt := NewSparseMerkleTree(nodes, values, hasher, opts...)
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+	smt.SetRoot(root)
+	smt.committedRoot = root
+	return smt, nil
 }
 
-// SetRoot sets the root of the tree.
-func (smt *SparseMerkleTree) SetRoot(root *SparseMerkleNode) *SparseMerkleTree {
-	if smt.root == nil {
-		smt.root = root
-	} else {
-		fmt.Println("root already exists")
-	}
+// Root gets the root hash of the tree.
+func (smt *SparseMerkleTree) Root() []byte {
+	return smt.root
+}
 
+// SetRoot sets the root hash of the tree.
+func (smt *SparseMerkleTree) SetRoot(root []byte) *SparseMerkleTree {
+	smt.root = root
 	return smt
 }
 
@@ -133,27 +227,27 @@ func NewMerkleTree(data [][]byte) *SparseMerkleTree {
 
 	nodes = level
 
-	tree := SparseMerkleTree{root: &nodes[0]}
+	tree := SparseMerkleTree{root: nodes[0].data}
 
 	return &tree
 }
 
 //Depth for the dept of the Sparse Merkle Tree
 func (smt *SparseMerkleTree) depth() int {
-	return smt.st.pathSize() * 8
+	return smt.st.depth
 }
 
 // Get gets the value of a key from the tree.
 func (smt *SparseMerkleTree) Get(key []byte) ([]byte, error) {
-	// Get tree's root
-	root := smt.GetRoot()
-
-	if root == nil {
+	if bytes.Equal(smt.Root(), smt.st.EmptyPlace()) {
 		// The tree is empty, return the default value.
 		return DefaultVal, nil
 	}
 
-	path := smt.st.path(key)
+	path, err := smt.st.path(key)
+	if err != nil {
+		return nil, err
+	}
 	value, err := smt.values.Get(path)
 
 	if err != nil {
@@ -176,19 +270,87 @@ func (smt *SparseMerkleTree) Check(key []byte) (bool, error) {
 	return !bytes.Equal(DefaultVal, val), err
 }
 
+// GetAt gets the value of a key from the tree at a specific root.
+// Unlike Get, it walks the nodes from the root, so it can read any past root whose nodes are still stored.
+func (smt *SparseMerkleTree) GetAt(key, root []byte) ([]byte, error) {
+	path, err := smt.st.path(key)
+	if err != nil {
+		return nil, err
+	}
+	_, pathNodes, leafData, _, err := smt.sideNodesForRoot(path, root, false)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(pathNodes[0], smt.st.EmptyPlace()) {
+		// The path leads to an empty subtree, return the default value.
+		return DefaultVal, nil
+	}
+	actualPath, valueHash := smt.st.parseLeaf(leafData)
+	if !bytes.Equal(path, actualPath) {
+		// The path leads to the leaf of a different key, return the default value.
+		return DefaultVal, nil
+	}
+
+	return smt.leafValue(pathNodes[0], path, valueHash)
+}
+
+// leafValue gets the value of a stored leaf.
+func (smt *SparseMerkleTree) leafValue(leafHash, path, valueHash []byte) ([]byte, error) {
+	// Values are stored under the hash of their leaf as well as under their path.
+	value, err := smt.values.Get(leafHash)
+	if err == nil {
+		return value, nil
+	}
+	var invalidKeyError *InvalidKey
+	if !errors.As(err, &invalidKeyError) {
+		return nil, err
+	}
+
+	// The leaf may have been written before values were stored under leaf hashes,
+	// in which case the latest value of the path is the only one that can be read.
+	latest, latestErr := smt.values.Get(path)
+	if latestErr == nil && bytes.Equal(smt.st.digest(latest), valueHash) {
+		return latest, nil
+	}
+	return nil, err
+}
+
+// CheckAt returns true if the value at given key is non-default at a specific root, and false otherwise.
+func (smt *SparseMerkleTree) CheckAt(key, root []byte) (bool, error) {
+	val, err := smt.GetAt(key, root)
+	return !bytes.Equal(DefaultVal, val), err
+}
+
 // Update sets a new value for a key in the tree, and sets and returns the new root of the tree.
 func (smt *SparseMerkleTree) Update(key []byte, value []byte) ([]byte, error) {
-	getroot := GobEncode(*smt.GetRoot())
-	newRoot, err := smt.RootUpdate(key, value, getroot)
+	newRoot, err := smt.RootUpdate(key, value, smt.Root())
 	if err != nil {
 		return nil, err
 	}
-	var root *SparseMerkleNode
-	setroot := GobDecode(newRoot, root)
-	smt.SetRoot(setroot)
+	if err := smt.moveRoot(newRoot); err != nil {
+		return nil, err
+	}
 	return newRoot, nil
 }
 
+// moveRoot sets the root of the tree to the result of an update of its current root.
+func (smt *SparseMerkleTree) moveRoot(newRoot []byte) error {
+	if smt.refCounted {
+		// The tree holds a reference to its root.
+		if err := smt.retain(newRoot); err != nil {
+			return err
+		}
+		if err := smt.release(smt.Root()); err != nil {
+			return err
+		}
+		if err := smt.releaseSnapshots(); err != nil {
+			return err
+		}
+	}
+	smt.SetRoot(newRoot)
+	return nil
+}
+
 // Delete deletes a value from tree. It returns the new default root of the tree.
 func (smt *SparseMerkleTree) Delete(key []byte) ([]byte, error) {
 	return smt.Update(key, DefaultVal)
@@ -196,7 +358,16 @@ func (smt *SparseMerkleTree) Delete(key []byte) ([]byte, error) {
 
 //RootUpdate set and return new value for the key in the tree at a specific root.
 func (smt *SparseMerkleTree) RootUpdate(key, value, root []byte) ([]byte, error) {
-	path := smt.st.path(key)
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+	path, err := smt.st.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := smt.checkCollision(path, key); err != nil {
+		return nil, err
+	}
 	sideNodes, pathNodes, OldLeafValue, _, err := smt.sideNodesForRoot(path, root, false)
 	if err != nil {
 		return nil, err
@@ -205,18 +376,30 @@ func (smt *SparseMerkleTree) RootUpdate(key, value, root []byte) ([]byte, error)
 	var NewRoot []byte
 	if bytes.Equal(value, DefaultVal) {
 		// Delete operation.
-		NewRoot, err = smt.DeleteNode(path, OldLeafValue, pathNodes, sideNodes)
-		if err != nil {
+		NewRoot, err = smt.DeleteNode(path, OldLeafValue, sideNodes, pathNodes)
+		if errors.Is(err, ErrKeyAlreadyEmpty) || errors.Is(err, ErrKeyNotFound) {
 			// This key is already empty; return the old root.
 			return root, nil
 		}
-		if err := smt.values.Delete(path); err != nil {
+		if err != nil {
+			return nil, err
+		}
+		if err := deleteIfExists(smt.values, path); err != nil {
+			return nil, err
+		}
+		if err := smt.clearPreimage(path); err != nil {
 			return nil, err
 		}
 
 	} else {
 		// Insert or update operation.
-		NewRoot, err = smt.UpdateNodes(path, value, OldLeafValue, pathNodes, sideNodes)
+		NewRoot, err = smt.UpdateNodes(path, OldLeafValue, value, sideNodes, pathNodes)
+		if err != nil {
+			return nil, err
+		}
+		if err := smt.setPreimage(path, key); err != nil {
+			return nil, err
+		}
 	}
 	return NewRoot, err
 }
@@ -228,49 +411,62 @@ func (smt *SparseMerkleTree) DeleteRoot(key, root []byte) ([]byte, error) {
 
 //DeleteNode deletes a value from the tree at a specific Node.It returns the new Node.
 func (smt *SparseMerkleTree) DeleteNode(path, OldLeafValue []byte, sideNodes, pathNodes [][]byte) ([]byte, error) {
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
 	if bytes.Equal(pathNodes[0], smt.st.EmptyPlace()) {
 
 		//This key is already empty so return an error.
-		return nil, fmt.Errorf("key is already empty")
+		return nil, ErrKeyAlreadyEmpty
 	}
 
 	ActualPath, _ := smt.st.parseLeaf(OldLeafValue)
 	if !bytes.Equal(path, ActualPath) {
 
 		//Both the keys are not similar then the different key was found at its place therefore return an error.
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 
 	}
 
 	//All nodes above the deleted node are now orphaned
-	for _, Node := range pathNodes {
-		if err := smt.nodes.Delete(Node); err != nil {
+	for i, Node := range pathNodes {
+		if err := smt.deleteOrphan(Node, i == 0); err != nil {
 			return nil, err
 		}
 	}
 
+	siblingIsLeaf := false
+	if len(sideNodes) > 0 {
+		sideNodeValue, err := smt.nodes.Get(sideNodes[0])
+		if err != nil {
+			return nil, err
+		}
+		siblingIsLeaf = smt.st.isLeaf(sideNodeValue)
+	}
+
+	return deleteWithSideNodes(&smt.st, path, sideNodes, siblingIsLeaf, smt.setNode)
+}
+
+// deleteWithSideNodes computes the root that results from removing the leaf of a path,
+// given its side nodes and whether its sibling is a leaf. setNode is called for every new node.
+func deleteWithSideNodes(st *SmtHasher, path []byte, sideNodes [][]byte, siblingIsLeaf bool, setNode func(hash, data []byte) error) ([]byte, error) {
 	var CurrentNodeHash, CurrentNodeData []byte
 	nonZeroValueReached := false
 	for i, sideNode := range sideNodes {
 		if CurrentNodeData == nil {
-			sideNodeValue, err := smt.nodes.Get(sideNode)
-			if err != nil {
-				return nil, err
-			}
-
-			if smt.st.isLeaf(sideNodeValue) {
+			if siblingIsLeaf {
 				//This is the leaf sibling that needs to be bubbled up the tree.
 				CurrentNodeHash = sideNode
 				CurrentNodeData = sideNode
 				continue
 			} else {
 				//This is the node sibling that needs to be left in its place.
-				CurrentNodeHash = smt.st.EmptyPlace()
+				CurrentNodeData = st.EmptyPlace()
 				nonZeroValueReached = true
 
 			}
 		}
-		if !nonZeroValueReached && bytes.Equal(sideNode, smt.st.zeroValue) {
+		if !nonZeroValueReached && bytes.Equal(sideNode, st.EmptyPlace()) {
 			// We found another placeholder sibling node, keep going up the
 			// tree until we find the first sibling that is not a placeholder.
 			continue
@@ -281,11 +477,11 @@ func (smt *SparseMerkleTree) DeleteNode(path, OldLeafValue []byte, sideNodes, pa
 		}
 
 		if getBitFromMSB(path, len(sideNodes)-1-i) == right {
-			CurrentNodeHash, CurrentNodeData = smt.st.digestNode(sideNode, CurrentNodeData)
+			CurrentNodeHash, CurrentNodeData = st.digestNode(sideNode, CurrentNodeData)
 		} else {
-			CurrentNodeHash, CurrentNodeData = smt.st.digestNode(CurrentNodeData, sideNode)
+			CurrentNodeHash, CurrentNodeData = st.digestNode(CurrentNodeData, sideNode)
 		}
-		if err := smt.nodes.Set(CurrentNodeHash, CurrentNodeData); err != nil {
+		if err := setNode(CurrentNodeHash, CurrentNodeData); err != nil {
 			return nil, err
 		}
 		CurrentNodeData = CurrentNodeHash
@@ -293,16 +489,89 @@ func (smt *SparseMerkleTree) DeleteNode(path, OldLeafValue []byte, sideNodes, pa
 
 	if CurrentNodeHash == nil {
 		// The tree is empty; return placeholder value as root.
-		CurrentNodeHash = smt.st.EmptyPlace()
+		CurrentNodeHash = st.EmptyPlace()
 	}
 	return CurrentNodeHash, nil
 }
 
 //UpdateNodes updates a value from the tree at a specific Node.It returns the new Node.
 func (smt *SparseMerkleTree) UpdateNodes(path, OldLeafValue []byte, value []byte, sideNodes, pathNodes [][]byte) ([]byte, error) {
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
 	valueHash := smt.st.digest(value)
-	currentNodeHash, currentNodeData := smt.st.digestLeaf(path, valueHash)
-	if err := smt.nodes.Set(currentNodeHash, currentNodeData); err != nil {
+
+	if !bytes.Equal(pathNodes[0], smt.st.EmptyPlace()) {
+		actualPath, oldValueHash := smt.st.parseLeaf(OldLeafValue)
+		if bytes.Equal(path, actualPath) {
+			// Short-circuit if the same value is being set
+			if bytes.Equal(oldValueHash, valueHash) {
+				return pathNodes[len(pathNodes)-1], nil
+			}
+			// If an old leaf exists, remove it
+			if err := smt.deleteOrphan(pathNodes[0], true); err != nil {
+				return nil, err
+			}
+			if err := deleteIfExists(smt.values, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// All remaining path nodes are orphaned
+	for i := 1; i < len(pathNodes); i++ {
+		if err := smt.deleteOrphan(pathNodes[i], false); err != nil {
+			return nil, err
+		}
+	}
+
+	currentNodeHash, err := updateWithSideNodes(&smt.st, smt.depth(), path, valueHash, pathNodes[0], OldLeafValue, sideNodes, smt.setNode)
+	if err != nil {
+		return nil, err
+	}
+	if err := smt.values.Set(path, value); err != nil {
+		return nil, err
+	}
+	leafHash, _ := smt.st.digestLeaf(path, valueHash)
+	if err := smt.values.Set(leafHash, value); err != nil {
+		return nil, err
+	}
+
+	return currentNodeHash, nil
+}
+
+// setNode stores a node created by an update.
+func (smt *SparseMerkleTree) setNode(nodeHash, nodeData []byte) error {
+	smt.unpinOrphan(nodeHash)
+	if smt.refCounted {
+		return smt.setCountedNode(nodeHash, nodeData)
+	}
+	return smt.nodes.Set(nodeHash, nodeData)
+}
+
+// deleteOrphan removes a node that is no longer part of the tree, and the value stored under it if it is a leaf.
+// Nothing is removed if the tree retains orphans, or if it frees nodes through their reference counts.
+// The removal waits while snapshots of the tree are live.
+func (smt *SparseMerkleTree) deleteOrphan(nodeHash []byte, isLeaf bool) error {
+	if smt.keepOrphans || smt.refCounted {
+		return nil
+	}
+	if pinned, err := smt.pinOrphan(nodeHash, isLeaf); pinned || err != nil {
+		return err
+	}
+	if err := smt.nodes.Delete(nodeHash); err != nil {
+		return err
+	}
+	if isLeaf {
+		return deleteIfExists(smt.values, nodeHash)
+	}
+	return nil
+}
+
+// updateWithSideNodes computes the root that results from setting the leaf of a path to valueHash,
+// given its side nodes and the leaf or EmptyPlace currently found there. setNode is called for every new node.
+func updateWithSideNodes(st *SmtHasher, depth int, path, valueHash, oldLeafHash, oldLeafData []byte, sideNodes [][]byte, setNode func(hash, data []byte) error) ([]byte, error) {
+	currentNodeHash, currentNodeData := st.digestLeaf(path, valueHash)
+	if err := setNode(currentNodeHash, currentNodeData); err != nil {
 		return nil, err
 	}
 	currentNodeData = currentNodeHash
@@ -313,61 +582,41 @@ func (smt *SparseMerkleTree) UpdateNodes(path, OldLeafValue []byte, value []byte
 
 	// First, get the number of bits that the paths of the two leaf nodes share in common as a prefix.
 	var commonPrefixCount int
-	var oldValueHash []byte
-	if bytes.Equal(pathNodes[0], smt.st.EmptyPlace()) {
-		commonPrefixCount = smt.depth()
+	if bytes.Equal(oldLeafHash, st.EmptyPlace()) {
+		commonPrefixCount = depth
 	} else {
-		var actualPath []byte
-		actualPath, oldValueHash = smt.st.parseLeaf(OldLeafValue)
-		commonPrefixCount = countCommonPrefix(path, actualPath)
+		actualPath, _ := st.parseLeaf(oldLeafData)
+		commonPrefixCount = countCommonPrefix(path, actualPath, depth)
 	}
-	if commonPrefixCount != smt.depth() {
+	if commonPrefixCount != depth {
 		if getBitFromMSB(path, commonPrefixCount) == right {
-			currentNodeHash, currentNodeData = smt.st.digestNode(pathNodes[0], currentNodeData)
+			currentNodeHash, currentNodeData = st.digestNode(oldLeafHash, currentNodeData)
 		} else {
-			currentNodeHash, currentNodeData = smt.st.digestNode(currentNodeData, pathNodes[0])
+			currentNodeHash, currentNodeData = st.digestNode(currentNodeData, oldLeafHash)
 		}
 
-		err := smt.nodes.Set(currentNodeHash, currentNodeData)
+		err := setNode(currentNodeHash, currentNodeData)
 		if err != nil {
 			return nil, err
 		}
 
 		currentNodeData = currentNodeHash
-	} else if oldValueHash != nil {
-		// Short-circuit if the same value is being set
-		if bytes.Equal(oldValueHash, valueHash) {
-			return GobEncode(*smt.root), nil
-		}
-		// If an old leaf exists, remove it
-		if err := smt.nodes.Delete(pathNodes[0]); err != nil {
-			return nil, err
-		}
-		if err := smt.values.Delete(path); err != nil {
-			return nil, err
-		}
-	}
-	// All remaining path nodes are orphaned
-	for i := 1; i < len(pathNodes); i++ {
-		if err := smt.nodes.Delete(pathNodes[i]); err != nil {
-			return nil, err
-		}
 	}
 
 	// The offset from the bottom of the tree to the start of the side nodes.
 	// Note: i-offsetOfSideNodes is the index into sideNodes[]
-	offsetOfSideNodes := smt.depth() - len(sideNodes)
+	offsetOfSideNodes := depth - len(sideNodes)
 
-	for i := 0; i < smt.depth(); i++ {
+	for i := 0; i < depth; i++ {
 		var sideNode []byte
 
 		if i-offsetOfSideNodes < 0 || sideNodes[i-offsetOfSideNodes] == nil {
-			if commonPrefixCount != smt.depth() && commonPrefixCount > smt.depth()-1-i {
+			if commonPrefixCount != depth && commonPrefixCount > depth-1-i {
 				// If there are no sideNodes at this height, but the number of
 				// bits that the paths of the two leaf nodes share in common is
 				// greater than this depth, then we need to build up the tree
 				// to this depth with placeholder values at siblings.
-				sideNode = smt.st.EmptyPlace()
+				sideNode = st.EmptyPlace()
 			} else {
 				continue
 			}
@@ -375,20 +624,17 @@ func (smt *SparseMerkleTree) UpdateNodes(path, OldLeafValue []byte, value []byte
 			sideNode = sideNodes[i-offsetOfSideNodes]
 		}
 
-		if getBitFromMSB(path, smt.depth()-1-i) == right {
-			currentNodeHash, currentNodeData = smt.st.digestNode(sideNode, currentNodeData)
+		if getBitFromMSB(path, depth-1-i) == right {
+			currentNodeHash, currentNodeData = st.digestNode(sideNode, currentNodeData)
 		} else {
-			currentNodeHash, currentNodeData = smt.st.digestNode(currentNodeData, sideNode)
+			currentNodeHash, currentNodeData = st.digestNode(currentNodeData, sideNode)
 		}
-		err := smt.nodes.Set(currentNodeHash, currentNodeData)
+		err := setNode(currentNodeHash, currentNodeData)
 		if err != nil {
 			return nil, err
 		}
 		currentNodeData = currentNodeHash
 	}
-	if err := smt.values.Set(path, value); err != nil {
-		return nil, err
-	}
 
 	return currentNodeHash, nil
 }
@@ -2,8 +2,8 @@ package smt
 
 import (
 	"bytes"
-	"golang.org/x/crypto/blake2b"
-	"hash"
+	"fmt"
+	"strconv"
 )
 
 var leafPrefix = []byte{0}
@@ -11,28 +11,82 @@ var nodePrefix = []byte{1}
 
 //SmtHasher struct used to hash the Sparse Merkle Tree
 type SmtHasher struct {
-	hasher    hash.Hash
+	th        TreeHasher
 	zeroValue []byte
+	// depth is the number of bits of the paths that the tree uses.
+	depth int
+	// rawKeys uses the keys as paths instead of their hashes.
+	rawKeys bool
 }
 
 //newSmtHasher for making a new Sparse Merkle Tree Hasher
-func newSmtHasher(hasher hash.Hash) *SmtHasher {
-	st := SmtHasher{hasher: hasher}
+func newSmtHasher(th TreeHasher) *SmtHasher {
+	st := SmtHasher{th: th}
 	st.zeroValue = make([]byte, st.pathSize())
+	st.depth = st.pathSize() * 8
 	return &st
 }
 
 func (st *SmtHasher) digest(data []byte) []byte {
-	st.hasher.Write(data)
-	s := st.hasher.Sum(nil)
-	sum := blake2b.Sum256(s)
-	Sum := sum[:]
-	st.hasher.Reset()
-	return Sum
+	return st.th.Value(data)
 }
 
-func (st *SmtHasher) path(key []byte) []byte {
-	return st.digest(key)
+// path returns the path of a key, which always has the size of a hash, with the bits after the
+// depth of the tree set to zero.
+func (st *SmtHasher) path(key []byte) ([]byte, error) {
+	if !st.rawKeys {
+		return st.truncate(st.th.Path(key)), nil
+	}
+	if keySize := (st.depth + 7) / 8; len(key) != keySize {
+		return nil, fmt.Errorf("key is %d bytes long, not %d", len(key), keySize)
+	}
+	path := make([]byte, st.pathSize())
+	copy(path, key)
+	if !bytes.Equal(st.truncate(path), path) {
+		return nil, fmt.Errorf("key is longer than %d bits", st.depth)
+	}
+	return path, nil
+}
+
+// checkLayout checks that the depth set by the options is between 1 and the size of the hashes in bits.
+func (st *SmtHasher) checkLayout() error {
+	if st.depth < 1 || st.depth > st.pathSize()*8 {
+		return fmt.Errorf("depth must be between 1 and %d bits, not %d", st.pathSize()*8, st.depth)
+	}
+	return nil
+}
+
+// truncatesHashes tells whether the paths are truncated hashes of the keys, which may be equal
+// for different keys.
+func (st *SmtHasher) truncatesHashes() bool {
+	return !st.rawKeys && st.depth < st.pathSize()*8
+}
+
+// truncate sets the bits of a path after the depth of the tree to zero.
+func (st *SmtHasher) truncate(path []byte) []byte {
+	if st.depth == len(path)*8 {
+		return path
+	}
+	truncated := emptyBytes(len(path))
+	copy(truncated, path[:st.depth/8])
+	for i := st.depth / 8 * 8; i < st.depth; i++ {
+		if getBitFromMSB(path, i) == 1 {
+			setBitFromMSB(truncated, i)
+		}
+	}
+	return truncated
+}
+
+// name identifies the hasher and the layout of the paths, to be stored with the tree.
+func (st *SmtHasher) name() string {
+	name := st.th.Name()
+	if st.depth != st.pathSize()*8 {
+		name += ",depth=" + strconv.Itoa(st.depth)
+	}
+	if st.rawKeys {
+		name += ",raw-keys"
+	}
+	return name
 }
 
 func (st *SmtHasher) digestLeaf(path []byte, leafData []byte) ([]byte, []byte) {
@@ -41,13 +95,7 @@ func (st *SmtHasher) digestLeaf(path []byte, leafData []byte) ([]byte, []byte) {
 	value = append(value, path...)
 	value = append(value, leafData...)
 
-	st.hasher.Write(value)
-	s := st.hasher.Sum(nil)
-	sum := blake2b.Sum256(s)
-	Sum := sum[:]
-	st.hasher.Reset()
-
-	return Sum, value
+	return st.th.Leaf(path, leafData), value
 }
 
 func (st *SmtHasher) parseLeaf(data []byte) ([]byte, []byte) {
@@ -64,21 +112,25 @@ func (st *SmtHasher) digestNode(leftData []byte, rightData []byte) ([]byte, []by
 	value = append(value, leftData...)
 	value = append(value, rightData...)
 
-	st.hasher.Write(value)
-	s := st.hasher.Sum(nil)
-	sum := blake2b.Sum256(s)
-	Sum := sum[:]
-	st.hasher.Reset()
-
-	return Sum, value
+	return st.th.Node(leftData, rightData), value
 }
 
 func (st *SmtHasher) parseNode(data []byte) ([]byte, []byte) {
 	return data[len(nodePrefix) : st.pathSize()+len(nodePrefix)], data[len(nodePrefix)+st.pathSize():]
 }
 
+// digestData hashes the stored data of a leaf or of a node.
+func (st *SmtHasher) digestData(data []byte) []byte {
+	if st.isLeaf(data) {
+		hash, _ := st.digestLeaf(st.parseLeaf(data))
+		return hash
+	}
+	hash, _ := st.digestNode(st.parseNode(data))
+	return hash
+}
+
 func (st *SmtHasher) pathSize() int {
-	return st.hasher.Size()
+	return st.th.Size()
 }
 
 func (st *SmtHasher) EmptyPlace() []byte {
@@ -0,0 +1,400 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// failingMap is a Map whose Delete fails once failDeletes is set.
+type failingMap struct {
+	*Map
+	failDeletes bool
+}
+
+var errStorage = errors.New("storage failure")
+
+func (m *failingMap) Delete(key []byte) error {
+	if m.failDeletes {
+		return errStorage
+	}
+	return m.Map.Delete(key)
+}
+
+func TestDeleteOfAbsentKeyKeepsRoot(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	if _, err := smt.Delete([]byte("absent")); err != nil {
+		t.Fatalf("delete from an empty tree: %v", err)
+	}
+	smt.Update([]byte("key"), []byte("value"))
+	root := smt.Root()
+	for _, key := range []string{"absent", "other"} {
+		newRoot, err := smt.Delete([]byte(key))
+		if err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		if !bytes.Equal(newRoot, root) {
+			t.Fatalf("delete %s changed the root", key)
+		}
+	}
+
+	// Find absent keys that reach an empty position and another leaf.
+	for i := 0; i < 10; i++ {
+		smt.Update([]byte{byte(i)}, []byte("value"))
+	}
+	root = smt.Root()
+	seen := make(map[error]bool)
+	for i := 0; len(seen) < 2 && i < 1000; i++ {
+		path, _ := smt.st.path([]byte{byte(i), byte(i >> 8), 1})
+		sideNodes, pathNodes, leafData, _, err := smt.sideNodesForRoot(path, root, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = smt.DeleteNode(path, leafData, sideNodes, pathNodes)
+		if !errors.Is(err, ErrKeyAlreadyEmpty) && !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("DeleteNode of an absent key returned %v", err)
+		}
+		seen[err] = true
+	}
+	if len(seen) != 2 {
+		t.Fatal("absent keys do not reach both an empty position and another leaf")
+	}
+}
+
+func TestDeleteReturnsStorageErrors(t *testing.T) {
+	nodes := &failingMap{Map: NewMap()}
+	smt := NewSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher())
+	smt.Update([]byte("key1"), []byte("value1"))
+	smt.Update([]byte("key2"), []byte("value2"))
+	root := smt.Root()
+
+	nodes.failDeletes = true
+	if _, err := smt.Delete([]byte("key1")); !errors.Is(err, errStorage) {
+		t.Fatalf("delete returned %v, want the storage error", err)
+	}
+	if !bytes.Equal(smt.Root(), root) {
+		t.Fatal("failed delete moved the root")
+	}
+}
+
+// mapEntries returns a copy of the entries of a Map, leaving out the metadata of the tree.
+func mapEntries(m *Map) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make(map[string]string)
+	for key, value := range m.m {
+		if !strings.HasPrefix(key, string(metaKeyPrefix)) {
+			entries[key] = string(value)
+		}
+	}
+	return entries
+}
+
+// sameEntries fails the test if two Maps hold different entries, leaving out the metadata of the tree.
+func sameEntries(t *testing.T, name string, got, want *Map) {
+	t.Helper()
+	gotEntries, wantEntries := mapEntries(got), mapEntries(want)
+	if len(gotEntries) != len(wantEntries) {
+		t.Fatalf("%s: %d entries, want %d", name, len(gotEntries), len(wantEntries))
+	}
+	for key, value := range wantEntries {
+		if gotValue, ok := gotEntries[key]; !ok || gotValue != value {
+			t.Fatalf("%s: entry %x differs", name, key)
+		}
+	}
+}
+
+func TestUpdateGetDeleteAndImport(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	smt := NewSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	if !bytes.Equal(smt.Root(), smt.st.EmptyPlace()) {
+		t.Fatal("new tree is not empty")
+	}
+	for i := 0; i < 100; i++ {
+		root, err := smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, smt.Root()) {
+			t.Fatal("Update returned another root than the root of the tree")
+		}
+	}
+	root := smt.Root()
+	if newRoot, _ := smt.Update([]byte("key5"), []byte("value5")); !bytes.Equal(newRoot, root) {
+		t.Fatal("setting the same value changed the root")
+	}
+	for i := 0; i < 100; i += 2 {
+		if _, err := smt.Delete([]byte(fmt.Sprint("key", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A tree reopened from its MapDbs and root reads the same values.
+	reopened, err := ImportSparseMerkleTree(nodes, values, NewSHA256Hasher(), smt.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value, err := reopened.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		present, _ := reopened.Check(key)
+		if want := i%2 == 1; present != want || (string(value) == fmt.Sprint("value", i)) != want {
+			t.Fatalf("key%d: got %q, present %v", i, value, present)
+		}
+	}
+
+	// Deleting every key leaves nothing behind.
+	for i := 0; i < 100; i++ {
+		reopened.Delete([]byte(fmt.Sprint("key", i)))
+	}
+	if !bytes.Equal(reopened.Root(), reopened.st.EmptyPlace()) {
+		t.Fatal("tree is not empty")
+	}
+	if n, m := len(mapEntries(nodes)), len(mapEntries(values)); n != 0 || m != 0 {
+		t.Fatalf("%d nodes and %d values left", n, m)
+	}
+}
+
+func TestReadsAtPastRoots(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithOrphanRetention())
+	var roots [][]byte
+	var models []map[string]string
+	model := make(map[string]string)
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprint("key", rng.Intn(50))
+		if rng.Intn(3) == 0 {
+			smt.Delete([]byte(key))
+			delete(model, key)
+		} else {
+			value := fmt.Sprint("value", i)
+			smt.Update([]byte(key), []byte(value))
+			model[key] = value
+		}
+		snapshot := make(map[string]string, len(model))
+		for k, v := range model {
+			snapshot[k] = v
+		}
+		roots = append(roots, smt.Root())
+		models = append(models, snapshot)
+	}
+
+	for i, root := range roots {
+		for j := 0; j < 50; j++ {
+			key := fmt.Sprint("key", j)
+			value, err := smt.GetAt([]byte(key), root)
+			if err != nil {
+				t.Fatalf("root %d, %s: %v", i, key, err)
+			}
+			if string(value) != models[i][key] {
+				t.Fatalf("root %d, %s: got %q, want %q", i, key, value, models[i][key])
+			}
+			present, err := smt.CheckAt([]byte(key), root)
+			if err != nil || present != (models[i][key] != "") {
+				t.Fatalf("root %d, %s: CheckAt returned %v, %v", i, key, present, err)
+			}
+			if j%5 != 0 {
+				continue
+			}
+			proof, err := smt.ProveAt([]byte(key), root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(proof, root, []byte(key), value, NewSHA256Hasher()) {
+				t.Fatalf("root %d, %s: proof does not verify", i, key)
+			}
+		}
+	}
+}
+
+func TestDepthAndRawKeys(t *testing.T) {
+	uint64Key := func(i int) []byte { return uint64Bytes(uint64(i)) }
+	for _, test := range []struct {
+		name string
+		opts []Option
+		key  func(i int) []byte
+	}{
+		{"64-bit raw keys", []Option{WithDepth(64), WithRawKeys()}, uint64Key},
+		{"12-bit raw keys", []Option{WithDepth(12), WithRawKeys()}, func(i int) []byte { return []byte{byte(i >> 4), byte(i<<4) & 0xf0} }},
+		{"256-bit raw keys", []Option{WithRawKeys()}, func(i int) []byte { return append(make([]byte, 24), uint64Key(i)...) }},
+		{"hashed keys", nil, func(i int) []byte { return []byte(fmt.Sprint("key", i)) }},
+		{"160-bit hashed keys", []Option{WithDepth(160)}, func(i int) []byte { return []byte(fmt.Sprint("key", i)) }},
+	} {
+		hasher := NewSHA256Hasher()
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), hasher, append([]Option{WithOrphanRetention()}, test.opts...)...)
+		batch := NewSparseMerkleTree(NewMap(), NewMap(), hasher, test.opts...)
+		model := make(map[string]string)
+		rng := rand.New(rand.NewSource(12))
+		for round := 0; round < 20; round++ {
+			var keys, values [][]byte
+			for i := 0; i < 40; i++ {
+				key := test.key(rng.Intn(300))
+				value := []byte(fmt.Sprint("value", rng.Intn(4)))
+				if rng.Intn(5) == 0 {
+					value = DefaultVal
+				}
+				if _, err := smt.Update(key, value); err != nil {
+					t.Fatalf("%s: %v", test.name, err)
+				}
+				keys, values = append(keys, key), append(values, value)
+				if len(value) == 0 {
+					delete(model, string(key))
+				} else {
+					model[string(key)] = string(value)
+				}
+			}
+			if _, err := batch.UpdateBatch(keys, values); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !bytes.Equal(batch.Root(), smt.Root()) {
+				t.Fatalf("%s: batch root differs", test.name)
+			}
+		}
+
+		root := smt.Root()
+		var keys, values [][]byte
+		for i := 0; i < 300; i++ {
+			key := test.key(i)
+			value, err := smt.Get(key)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if string(value) != model[string(key)] {
+				t.Fatalf("%s: key %x reads %q, want %q", test.name, key, value, model[string(key)])
+			}
+			proof, err := smt.Prove(key)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !VerifyProof(proof, root, key, value, hasher, test.opts...) {
+				t.Fatalf("%s: proof of %x does not verify", test.name, key)
+			}
+			compact, _ := CompactProof(proof, hasher, test.opts...)
+			if !VerifyCompactProof(compact, root, key, value, hasher, test.opts...) {
+				t.Fatalf("%s: compact proof of %x does not verify", test.name, key)
+			}
+			newRoot, err := UpdateRootWithProof(proof, root, key, value, []byte("new"), hasher, test.opts...)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if want, _ := smt.RootUpdate(key, []byte("new"), root); !bytes.Equal(newRoot, want) {
+				t.Fatalf("%s: root from the update proof of %x differs", test.name, key)
+			}
+			if i%7 == 0 {
+				keys, values = append(keys, key), append(values, value)
+			}
+		}
+		proof, err := smt.ProveMulti(keys)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !VerifyMultiProof(proof, root, keys, values, hasher, test.opts...) {
+			t.Fatalf("%s: multiproof does not verify", test.name)
+		}
+	}
+}
+
+func TestRawKeysAreValidated(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDepth(64), WithRawKeys())
+	if _, err := smt.Update([]byte{1, 2, 3}, []byte("value")); err == nil {
+		t.Error("key of the wrong length was accepted")
+	}
+	smt = NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDepth(12), WithRawKeys())
+	if _, err := smt.Update([]byte{1, 1}, []byte("value")); err == nil {
+		t.Error("key with bits after the depth was accepted")
+	}
+	if _, err := smt.Update([]byte{1, 0x10}, []byte("value")); err != nil {
+		t.Errorf("valid key was rejected: %v", err)
+	}
+}
+
+func TestRawKeysAreLaidOutInOrder(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDepth(64), WithRawKeys())
+	for i := 10; i > 0; i-- {
+		smt.Update(uint64Bytes(uint64(i*100)), []byte("value"))
+	}
+	var previous []byte
+	err := smt.Iterate(smt.Root(), nil, func(path, _, _, _ []byte) error {
+		if previous != nil && bytes.Compare(previous, path) >= 0 {
+			t.Fatalf("path %x comes after %x", path, previous)
+		}
+		previous = path
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(previous[:8], uint64Bytes(1000)) {
+		t.Fatalf("last path is %x", previous)
+	}
+}
+
+func TestTruncatedHashedKeysCollide(t *testing.T) {
+	// Two keys whose hashes share their first 8 bits.
+	hasher := NewSHA256Hasher()
+	seen := make(map[byte][]byte)
+	var key, other []byte
+	for i := 0; other == nil; i++ {
+		candidate := []byte(fmt.Sprint("key", i))
+		first := hasher.Path(candidate)[0]
+		if seen[first] != nil {
+			key, other = seen[first], candidate
+		}
+		seen[first] = candidate
+	}
+
+	var collision *KeyCollision
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), hasher, WithDepth(8), WithPreimages(NewMap()))
+	smt.Update(key, []byte("value"))
+	if _, err := smt.Update(other, []byte("other")); !errors.As(err, &collision) {
+		t.Fatalf("update of a colliding key returned %v", err)
+	}
+	if _, err := smt.Delete(other); !errors.As(err, &collision) {
+		t.Fatalf("delete of a colliding key returned %v", err)
+	}
+	if value, _ := smt.Get(key); string(value) != "value" {
+		t.Fatalf("key reads %q after a collision", value)
+	}
+	// Once the key is deleted, the other key can take its path.
+	smt.Delete(key)
+	if _, err := smt.Update(other, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := NewSparseMerkleTree(NewMap(), NewMap(), hasher, WithDepth(8))
+	if _, err := batch.UpdateBatch([][]byte{key, other}, [][]byte{[]byte("value"), []byte("other")}); !errors.As(err, &collision) {
+		t.Fatalf("batch of colliding keys returned %v", err)
+	}
+	if _, err := BuildSparseMerkleTree(NewMap(), NewMap(), hasher, [][]byte{key, other}, [][]byte{[]byte("value"), []byte("other")}, 2, WithDepth(8)); !errors.As(err, &collision) {
+		t.Fatalf("bulk build of colliding keys returned %v", err)
+	}
+}
+
+func TestInvalidDepthIsAnError(t *testing.T) {
+	hasher := NewSHA256Hasher()
+	for _, depth := range []int{0, -1, 257} {
+		if err := ValidateOptions(hasher, WithDepth(depth)); err == nil {
+			t.Fatalf("depth %d is valid", depth)
+		}
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), hasher, WithDepth(depth))
+		if _, err := smt.Update([]byte("key"), []byte("value")); err == nil {
+			t.Fatalf("tree with a depth of %d was written", depth)
+		}
+		if _, err := ImportSparseMerkleTree(NewMap(), NewMap(), hasher, smt.Root(), WithDepth(depth)); err == nil {
+			t.Fatalf("tree with a depth of %d was imported", depth)
+		}
+		proof, _ := smt.Prove([]byte("key"))
+		if VerifyProof(proof, smt.Root(), []byte("key"), DefaultVal, hasher, WithDepth(depth)) {
+			t.Fatalf("proof verifies with a depth of %d", depth)
+		}
+	}
+	if err := ValidateOptions(hasher, WithDepth(160)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,370 @@
+package smt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A snapshot holds the leaves of a tree at a root, so that the tree can be rebuilt elsewhere.
+// It is made of a header and of chunks of leaves in path order, all numbers being big-endian:
+//
+//	header: "SMTSNP" | version (1 byte) | hasher ID length (1 byte) | hasher ID | depth (2 bytes) |
+//	        flags (1 byte) | root length (1 byte) | root | CRC-32C of the header so far (4 bytes)
+//	chunk:  leaf count (4 bytes) | leaves | CRC-32C of the chunk so far (4 bytes)
+//	leaf:   path | key length (4 bytes) | key | value length (4 bytes) | value
+//
+// The last chunk has no leaves. Keys are only included if the keysFlag is set, and a tree gives
+// the same snapshot for the same root and flags.
+var snapshotMagic = []byte("SMTSNP")
+
+const (
+	snapshotVersion = 1
+	// snapshotChunkSize is the number of leaves in each chunk but the last ones.
+	snapshotChunkSize = 1024
+	// snapshotMaxField is the largest key or value a snapshot is read with.
+	snapshotMaxField = 1 << 26
+
+	rawKeysFlag = 1 << 0 // rawKeysFlag is set if paths are keys (see WithRawKeys).
+	keysFlag    = 1 << 1 // keysFlag is set if the snapshot holds the key of each leaf.
+)
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SnapshotHeader describes the tree held by a snapshot.
+type SnapshotHeader struct {
+	Version  byte
+	HasherID string
+	Depth    int
+	RawKeys  bool
+	HasKeys  bool
+	Root     []byte
+}
+
+// ExportSnapshot writes a snapshot of the tree at the given root. The keys of the leaves are
+// included if the tree has a preimage store (see WithPreimages).
+func (smt *SparseMerkleTree) ExportSnapshot(root []byte, w io.Writer) error {
+	header := SnapshotHeader{
+		Version:  snapshotVersion,
+		HasherID: smt.st.th.Name(),
+		Depth:    smt.depth(),
+		RawKeys:  smt.st.rawKeys,
+		HasKeys:  smt.preimages != nil,
+		Root:     root,
+	}
+	sw := snapshotWriter{w: bufio.NewWriter(w)}
+	if err := sw.writeHeader(header); err != nil {
+		return err
+	}
+
+	err := smt.Iterate(root, nil, func(path, key, _, value []byte) error {
+		if header.HasKeys && key == nil {
+			return &InvalidKey{Key: path}
+		}
+		return sw.addLeaf(path, key, value)
+	})
+	if err != nil {
+		return err
+	}
+	if sw.numLeaves > 0 {
+		if err := sw.flushChunk(); err != nil {
+			return err
+		}
+	}
+	// The last chunk is empty.
+	if err := sw.flushChunk(); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// ImportSnapshot rebuilds the tree of a snapshot in the given MapDbs, and returns it at the root of
+// the snapshot. If hasher is nil, the built-in hasher named by the snapshot is used. The depth and
+// the raw keys of the snapshot override the options. It fails if the snapshot is corrupted, or if
+// the root of the rebuilt tree is not the one of the snapshot, in which case the MapDbs may hold
+// nodes of the partial tree.
+func ImportSnapshot(r io.Reader, nodes, values MapDb, hasher TreeHasher, opts ...Option) (*SparseMerkleTree, error) {
+	sr := snapshotReader{r: bufio.NewReader(r)}
+	header, err := sr.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if hasher == nil {
+		if hasher = builtinHasher(header.HasherID); hasher == nil {
+			return nil, fmt.Errorf("unknown hasher %q", header.HasherID)
+		}
+	}
+	if hasher.Name() != header.HasherID {
+		return nil, &InvalidHasher{Stored: header.HasherID, Hasher: hasher.Name()}
+	}
+	if header.Depth < 1 || header.Depth > hasher.Size()*8 {
+		return nil, errors.New("invalid snapshot depth")
+	}
+	// Appended last, so that the layout of the snapshot overrides the options in both directions.
+	opts = append(opts, WithDepth(header.Depth), withRawKeys(header.RawKeys))
+
+	smt := NewSparseMerkleTree(nodes, values, hasher, opts...)
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+	b := newSortedBuilder(smt)
+	for {
+		leaves, err := sr.readChunk(smt.st.pathSize(), header.HasKeys)
+		if err != nil {
+			return nil, err
+		}
+		if len(leaves) == 0 {
+			break
+		}
+		for _, leaf := range leaves {
+			if err := smt.importLeaf(b, leaf); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	root, err := b.root()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(root, header.Root) {
+		return nil, fmt.Errorf("snapshot root %x does not match rebuilt root %x", header.Root, root)
+	}
+	if err := smt.moveRoot(root); err != nil {
+		return nil, err
+	}
+	smt.committedRoot = root
+	return smt, nil
+}
+
+// withRawKeys sets whether the keys are used as paths, unlike WithRawKeys which can only set it.
+func withRawKeys(rawKeys bool) Option {
+	return func(tree *SparseMerkleTree) {
+		tree.st.rawKeys = rawKeys
+	}
+}
+
+// importLeaf adds a leaf of a snapshot to the tree being rebuilt, with its values and key.
+func (smt *SparseMerkleTree) importLeaf(b *sortedBuilder, leaf RangeLeaf) error {
+	if !bytes.Equal(smt.st.truncate(leaf.Path), leaf.Path) {
+		return errors.New("snapshot path is longer than the tree depth")
+	}
+	if err := smt.checkLeafKey(leaf); err != nil {
+		return err
+	}
+	leafHash, err := b.add(leaf.Path, smt.st.digest(leaf.Value))
+	if err != nil {
+		return err
+	}
+	return smt.setLeafValue(leaf, leafHash)
+}
+
+// checkLeafKey checks that the key of a leaf received from another tree, if any, is the one of its path.
+func (smt *SparseMerkleTree) checkLeafKey(leaf RangeLeaf) error {
+	if leaf.Key == nil {
+		return nil
+	}
+	path, err := smt.st.path(leaf.Key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(path, leaf.Path) {
+		return &InvalidKey{Key: leaf.Key}
+	}
+	return nil
+}
+
+// setLeafValue stores the value of a leaf received from another tree under its path and its leaf
+// hash, and its key if any.
+func (smt *SparseMerkleTree) setLeafValue(leaf RangeLeaf, leafHash []byte) error {
+	if err := smt.values.Set(leaf.Path, leaf.Value); err != nil {
+		return err
+	}
+	if err := smt.values.Set(leafHash, leaf.Value); err != nil {
+		return err
+	}
+	if leaf.Key != nil {
+		return smt.setPreimage(leaf.Path, leaf.Key)
+	}
+	return nil
+}
+
+// snapshotWriter writes the header and the chunks of a snapshot.
+type snapshotWriter struct {
+	w         *bufio.Writer
+	chunk     []byte
+	numLeaves int
+	hasKeys   bool
+}
+
+func (sw *snapshotWriter) writeHeader(header SnapshotHeader) error {
+	if len(header.HasherID) > 255 || len(header.Root) > 255 {
+		return errors.New("snapshot header field is too long")
+	}
+	var flags byte
+	if header.RawKeys {
+		flags |= rawKeysFlag
+	}
+	if header.HasKeys {
+		flags |= keysFlag
+	}
+	sw.hasKeys = header.HasKeys
+
+	data := append([]byte{}, snapshotMagic...)
+	data = append(data, header.Version, byte(len(header.HasherID)))
+	data = append(data, header.HasherID...)
+	data = append(data, byte(header.Depth>>8), byte(header.Depth), flags, byte(len(header.Root)))
+	data = append(data, header.Root...)
+	data = append(data, uint32Bytes(crc32.Checksum(data, snapshotTable))...)
+	_, err := sw.w.Write(data)
+	return err
+}
+
+// addLeaf adds a leaf to the current chunk, and writes the chunk once it is full.
+func (sw *snapshotWriter) addLeaf(path, key, value []byte) error {
+	sw.chunk = append(sw.chunk, path...)
+	if sw.hasKeys {
+		sw.chunk = append(sw.chunk, uint32Bytes(uint32(len(key)))...)
+		sw.chunk = append(sw.chunk, key...)
+	}
+	sw.chunk = append(sw.chunk, uint32Bytes(uint32(len(value)))...)
+	sw.chunk = append(sw.chunk, value...)
+	sw.numLeaves++
+	if sw.numLeaves < snapshotChunkSize {
+		return nil
+	}
+	return sw.flushChunk()
+}
+
+// flushChunk writes the current chunk, which may be empty.
+func (sw *snapshotWriter) flushChunk() error {
+	data := append(uint32Bytes(uint32(sw.numLeaves)), sw.chunk...)
+	data = append(data, uint32Bytes(crc32.Checksum(data, snapshotTable))...)
+	sw.chunk, sw.numLeaves = sw.chunk[:0], 0
+	_, err := sw.w.Write(data)
+	return err
+}
+
+// snapshotReader reads the header and the chunks of a snapshot, checking their checksums.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+// read reads n bytes, and adds them to the checksum.
+func (sr *snapshotReader) read(n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	sr.crc = crc32.Update(sr.crc, snapshotTable, data)
+	return data, nil
+}
+
+func (sr *snapshotReader) readUint32() (uint32, error) {
+	data, err := sr.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// readField reads a byte slice prefixed with its length.
+func (sr *snapshotReader) readField() ([]byte, error) {
+	n, err := sr.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if n > snapshotMaxField {
+		return nil, errors.New("snapshot field is too long")
+	}
+	return sr.read(int(n))
+}
+
+// checkCRC reads the checksum of the data read since the last one.
+func (sr *snapshotReader) checkCRC() error {
+	expected := sr.crc
+	crc, err := sr.readUint32()
+	if err != nil {
+		return err
+	}
+	if crc != expected {
+		return errors.New("snapshot checksum mismatch")
+	}
+	sr.crc = 0
+	return nil
+}
+
+func (sr *snapshotReader) readHeader() (SnapshotHeader, error) {
+	magic, err := sr.read(len(snapshotMagic))
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return SnapshotHeader{}, errors.New("not a snapshot")
+	}
+	fields, err := sr.read(2)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header := SnapshotHeader{Version: fields[0]}
+	if header.Version != snapshotVersion {
+		return SnapshotHeader{}, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	hasherID, err := sr.read(int(fields[1]))
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header.HasherID = string(hasherID)
+	fields, err = sr.read(4)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header.Depth = int(binary.BigEndian.Uint16(fields))
+	header.RawKeys = fields[2]&rawKeysFlag != 0
+	header.HasKeys = fields[2]&keysFlag != 0
+	if header.Root, err = sr.read(int(fields[3])); err != nil {
+		return SnapshotHeader{}, err
+	}
+	return header, sr.checkCRC()
+}
+
+// readChunk reads the leaves of the next chunk. The path of each leaf is pathSize bytes long.
+func (sr *snapshotReader) readChunk(pathSize int, hasKeys bool) ([]RangeLeaf, error) {
+	n, err := sr.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if n > snapshotChunkSize {
+		return nil, errors.New("snapshot chunk is too large")
+	}
+	leaves := make([]RangeLeaf, n)
+	for i := range leaves {
+		if leaves[i].Path, err = sr.read(pathSize); err != nil {
+			return nil, err
+		}
+		if hasKeys {
+			if leaves[i].Key, err = sr.readField(); err != nil {
+				return nil, err
+			}
+		}
+		if leaves[i].Value, err = sr.readField(); err != nil {
+			return nil, err
+		}
+	}
+	return leaves, sr.checkCRC()
+}
+
+// uint32Bytes encodes an integer as 4 big-endian bytes.
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
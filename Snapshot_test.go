@@ -0,0 +1,149 @@
+package smt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestExportAndImportSnapshot(t *testing.T) {
+	for _, c := range []struct {
+		numLeaves int
+		opts      func() []Option
+	}{
+		{0, func() []Option { return nil }},
+		{1, func() []Option { return nil }},
+		// More leaves than a chunk holds, and exactly a chunk.
+		{2500, func() []Option { return nil }},
+		{snapshotChunkSize, func() []Option { return []Option{WithDepth(64), WithRawKeys()} }},
+		{700, func() []Option { return []Option{WithPreimages(NewMap())} }},
+		{300, func() []Option { return []Option{WithReferenceCounting()} }},
+	} {
+		name := fmt.Sprintf("%d leaves, %d options", c.numLeaves, len(c.opts()))
+		nodes, values := NewMap(), NewMap()
+		smt := NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), c.opts()...)
+		for i := 0; i < c.numLeaves; i++ {
+			if _, err := smt.Update(uint64Bytes(uint64(i*7919)), []byte(fmt.Sprint("value", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := smt.ExportSnapshot(smt.Root(), &buf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data := buf.Bytes()
+
+		importedNodes, importedValues := NewMap(), NewMap()
+		imported, err := ImportSnapshot(bytes.NewReader(data), importedNodes, importedValues, nil, c.opts()...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(imported.Root(), smt.Root()) {
+			t.Fatalf("%s: imported root differs", name)
+		}
+		for i := 0; i < c.numLeaves; i++ {
+			value, err := imported.Get(uint64Bytes(uint64(i * 7919)))
+			if err != nil || string(value) != fmt.Sprint("value", i) {
+				t.Fatalf("%s: leaf %d reads %q, %v", name, i, value, err)
+			}
+		}
+		if c.numLeaves > 0 {
+			sameEntries(t, name+": nodes", importedNodes, nodes)
+			sameEntries(t, name+": values", importedValues, values)
+		}
+		if imported.preimages != nil {
+			key := uint64Bytes(7919 * 5)
+			path, _ := imported.st.path(key)
+			if preimage, err := imported.KeyOf(path); err != nil || !bytes.Equal(preimage, key) {
+				t.Fatalf("%s: imported preimage %x, %v", name, preimage, err)
+			}
+		}
+
+		// The same root gives the same snapshot, and the imported tree can be updated.
+		var reexported bytes.Buffer
+		if err := imported.ExportSnapshot(imported.Root(), &reexported); err != nil || !bytes.Equal(reexported.Bytes(), data) {
+			t.Fatalf("%s: re-exported snapshot differs, %v", name, err)
+		}
+		if _, err := imported.Update(uint64Bytes(1), []byte("value")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestImportSnapshotRejectsCorruption(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithPreimages(NewMap()))
+	for i := 0; i < 1500; i++ {
+		smt.Update(uint64Bytes(uint64(i)), []byte(fmt.Sprint("value", i)))
+	}
+	var buf bytes.Buffer
+	if err := smt.ExportSnapshot(smt.Root(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for pos := 0; pos < len(data); pos += 1 + len(data)/200 {
+		corrupted := append([]byte{}, data...)
+		corrupted[pos] ^= 0x40
+		if _, err := ImportSnapshot(bytes.NewReader(corrupted), NewMap(), NewMap(), nil, WithPreimages(NewMap())); err == nil {
+			t.Fatalf("snapshot corrupted at byte %d was imported", pos)
+		}
+	}
+	if _, err := ImportSnapshot(bytes.NewReader(data[:len(data)-1]), NewMap(), NewMap(), nil); err == nil {
+		t.Fatal("truncated snapshot was imported")
+	}
+	if _, err := ImportSnapshot(bytes.NewReader(data), NewMap(), NewMap(), NewSHA3Hasher()); err == nil {
+		t.Fatal("snapshot was imported with another hasher")
+	}
+}
+
+func TestImportSnapshotRejectsRootMismatch(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	smt.Update([]byte("key1"), []byte("value1"))
+	smt.Update([]byte("key2"), []byte("value2"))
+
+	// The header claims another root than the one of the leaves, with valid checksums.
+	var buf bytes.Buffer
+	sw := snapshotWriter{w: bufio.NewWriter(&buf)}
+	sw.writeHeader(SnapshotHeader{Version: snapshotVersion, HasherID: "sha256", Depth: 256, Root: make([]byte, 32)})
+	smt.Iterate(smt.Root(), nil, func(path, _, _, value []byte) error {
+		return sw.addLeaf(path, nil, value)
+	})
+	sw.flushChunk()
+	sw.flushChunk()
+	sw.w.Flush()
+	if _, err := ImportSnapshot(&buf, NewMap(), NewMap(), nil); err == nil {
+		t.Fatal("snapshot with a mismatched root was imported")
+	}
+}
+
+func TestImportSnapshotOverridesRawKeys(t *testing.T) {
+	hashed := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	raw := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithDepth(64), WithRawKeys())
+	for i := 0; i < 100; i++ {
+		hashed.Update(uint64Bytes(uint64(i)), []byte("value"))
+		raw.Update(uint64Bytes(uint64(i)), []byte("value"))
+	}
+	for _, c := range []struct {
+		smt  *SparseMerkleTree
+		opts []Option
+	}{
+		{hashed, []Option{WithRawKeys()}},
+		{raw, nil},
+	} {
+		var buf bytes.Buffer
+		if err := c.smt.ExportSnapshot(c.smt.Root(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		imported, err := ImportSnapshot(&buf, NewMap(), NewMap(), nil, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported.st.rawKeys != c.smt.st.rawKeys {
+			t.Fatalf("imported tree has raw keys %v, want %v", imported.st.rawKeys, c.smt.st.rawKeys)
+		}
+		// Updating a key already in the tree leaves the root unchanged.
+		if root, err := imported.Update(uint64Bytes(7), []byte("value")); err != nil || !bytes.Equal(root, c.smt.Root()) {
+			t.Fatalf("update of an imported leaf changed the root, %v", err)
+		}
+	}
+}
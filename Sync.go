@@ -0,0 +1,329 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A tree at a root is synced in 2^chunkBits chunks, the chunk with index i holding the leaves
+// whose paths start with the chunkBits bits of i. Each chunk comes with a range proof, so that it
+// can be verified against the root on its own and written as soon as it is received.
+
+// maxSyncChunkBits is the largest number of bits of the index of a sync chunk.
+const maxSyncChunkBits = 16
+
+// syncProgressKeyPrefix is the prefix of the key under which the chunks synced towards a root are
+// recorded in the nodes MapDb, so that an interrupted sync can resume.
+var syncProgressKeyPrefix = []byte("smt:sync:")
+
+// unfinishedSyncsKey is the key under which the roots of the syncs that have written some but not
+// all of their chunks are recorded in the nodes MapDb. The tree may then hold nodes without their
+// subtrees.
+var unfinishedSyncsKey = []byte("smt:syncs")
+
+// SyncChunk is a chunk of the leaves of a tree at a root, with the proof that they are all of the
+// leaves in the range of the chunk.
+type SyncChunk struct {
+	Index  int
+	Leaves []RangeLeaf
+	Proof  SparseMerkleRangeProof
+}
+
+// SyncTransport fetches the chunks of a tree for a StateSync.
+type SyncTransport interface {
+	// FetchChunk fetches the chunk with the given index of the tree at a root split into
+	// 2^chunkBits chunks. It may be called from several goroutines at once.
+	FetchChunk(root []byte, index, chunkBits int) (SyncChunk, error)
+}
+
+// LocalSyncTransport fetches the chunks of a tree in the same process. The tree must not be
+// updated during the sync.
+type LocalSyncTransport struct {
+	Tree *SparseMerkleTree
+}
+
+func (t LocalSyncTransport) FetchChunk(root []byte, index, chunkBits int) (SyncChunk, error) {
+	return t.Tree.SyncChunk(root, index, chunkBits)
+}
+
+// SyncChunk returns the chunk with the given index of the tree at a root split into 2^chunkBits chunks.
+func (smt *SparseMerkleTree) SyncChunk(root []byte, index, chunkBits int) (SyncChunk, error) {
+	if err := checkSyncChunk(&smt.st, index, chunkBits); err != nil {
+		return SyncChunk{}, err
+	}
+	start, end := syncRange(&smt.st, index, chunkBits)
+	leaves, proof, err := smt.ProveRange(root, start, end)
+	if err != nil {
+		return SyncChunk{}, err
+	}
+	return SyncChunk{Index: index, Leaves: leaves, Proof: proof}, nil
+}
+
+// checkSyncChunk checks that a chunk index and a number of chunk bits are valid for a tree.
+func checkSyncChunk(st *SmtHasher, index, chunkBits int) error {
+	if chunkBits < 0 || chunkBits > maxSyncChunkBits || chunkBits > st.depth {
+		return fmt.Errorf("invalid number of chunk bits %d", chunkBits)
+	}
+	if index < 0 || index >= 1<<chunkBits {
+		return fmt.Errorf("invalid chunk index %d", index)
+	}
+	return nil
+}
+
+// syncRange returns the first and the last paths of the chunk with the given index.
+func syncRange(st *SmtHasher, index, chunkBits int) ([]byte, []byte) {
+	start, end := emptyBytes(st.pathSize()), emptyBytes(st.pathSize())
+	for i := 0; i < st.depth; i++ {
+		if i >= chunkBits {
+			setBitFromMSB(end, i)
+		} else if index>>(chunkBits-1-i)&1 == 1 {
+			setBitFromMSB(start, i)
+			setBitFromMSB(end, i)
+		}
+	}
+	return start, end
+}
+
+// StateSync syncs a tree to a trusted root, one verified chunk at a time. The chunks already
+// written are recorded in the nodes MapDb, so that a new StateSync towards the same root only
+// fetches the others. The tree is moved to the root once all of the chunks are written, and the
+// record is kept so that a new StateSync towards the root is done at once. A tree cannot be
+// reconciled while a sync has written some but not all of its chunks.
+type StateSync struct {
+	smt       *SparseMerkleTree
+	root      []byte
+	chunkBits int
+	// synced has one bit per chunk, set once the chunk is written.
+	synced []byte
+}
+
+// NewStateSync starts or resumes syncing a tree to a root in 2^chunkBits chunks. A resumed sync
+// must use the same number of chunk bits.
+func NewStateSync(smt *SparseMerkleTree, root []byte, chunkBits int) (*StateSync, error) {
+	if len(root) != smt.st.pathSize() {
+		return nil, errors.New("invalid root size")
+	}
+	if err := checkSyncChunk(&smt.st, 0, chunkBits); err != nil {
+		return nil, err
+	}
+	if err := smt.checkHasher(); err != nil {
+		return nil, err
+	}
+
+	s := &StateSync{smt: smt, root: root, chunkBits: chunkBits, synced: make([]byte, (1<<chunkBits+7)/8)}
+	progress, err := getIfExists(smt.nodes, s.progressKey())
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		if len(progress) != 1+len(s.synced) || int(progress[0]) != chunkBits {
+			return nil, fmt.Errorf("sync towards %x was started with other chunk bits", root)
+		}
+		copy(s.synced, progress[1:])
+	}
+	if s.Done() {
+		// The tree already holds its reference to the root, as for ImportSparseMerkleTree.
+		smt.SetRoot(root)
+		smt.committedRoot = root
+	}
+	return s, nil
+}
+
+func (s *StateSync) progressKey() []byte {
+	return append(append([]byte{}, syncProgressKeyPrefix...), s.root...)
+}
+
+// Pending returns the indexes of the chunks that are not written yet.
+func (s *StateSync) Pending() []int {
+	var pending []int
+	for index := 0; index < 1<<s.chunkBits; index++ {
+		if getBitFromMSB(s.synced, index) == 0 {
+			pending = append(pending, index)
+		}
+	}
+	return pending
+}
+
+// Done tells whether all of the chunks are written.
+func (s *StateSync) Done() bool {
+	return len(s.Pending()) == 0
+}
+
+// Apply verifies a chunk against the root, and writes its nodes and leaves to the tree. Nothing
+// is written if the chunk is invalid. A chunk that is already written is ignored.
+func (s *StateSync) Apply(chunk SyncChunk) error {
+	if err := checkSyncChunk(&s.smt.st, chunk.Index, s.chunkBits); err != nil {
+		return err
+	}
+	if getBitFromMSB(s.synced, chunk.Index) == 1 {
+		return nil
+	}
+	for _, leaf := range chunk.Leaves {
+		if err := s.smt.checkLeafKey(leaf); err != nil {
+			return err
+		}
+	}
+	start, end := syncRange(&s.smt.st, chunk.Index, s.chunkBits)
+	nodes, ok := verifyRangeProof(&s.smt.st, chunk.Proof, s.root, start, end, chunk.Leaves, true)
+	if !ok {
+		return fmt.Errorf("invalid proof for sync chunk %d", chunk.Index)
+	}
+
+	if len(s.Pending()) == 1<<s.chunkBits {
+		if err := s.smt.setUnfinishedSync(s.root, true); err != nil {
+			return err
+		}
+	}
+	// The nodes include those on the way from the root to the chunk, which other chunks share.
+	for _, node := range nodes {
+		if err := s.smt.setNode(node.hash, node.data); err != nil {
+			return err
+		}
+	}
+	for _, leaf := range chunk.Leaves {
+		leafHash, _ := s.smt.st.digestLeaf(leaf.Path, s.smt.st.digest(leaf.Value))
+		if err := s.smt.setLeafValue(leaf, leafHash); err != nil {
+			return err
+		}
+	}
+
+	synced := append([]byte{}, s.synced...)
+	setBitFromMSB(synced, chunk.Index)
+	if len(s.Pending()) > 1 {
+		return s.saveProgress(synced)
+	}
+	// The last chunk is only recorded once the tree is moved to the root, so that a sync
+	// interrupted before then fetches it again and finishes the move.
+	if err := s.smt.syncLatestValues(s.root); err != nil {
+		return err
+	}
+	if err := s.smt.moveRoot(s.root); err != nil {
+		return err
+	}
+	s.smt.committedRoot = s.root
+	if err := s.smt.setUnfinishedSync(s.root, false); err != nil {
+		return err
+	}
+	return s.saveProgress(synced)
+}
+
+// saveProgress records the chunks that are written.
+func (s *StateSync) saveProgress(synced []byte) error {
+	if err := s.smt.nodes.Set(s.progressKey(), append([]byte{byte(s.chunkBits)}, synced...)); err != nil {
+		return err
+	}
+	s.synced = synced
+	return nil
+}
+
+// setUnfinishedSync adds a root to the roots of the unfinished syncs, or removes it.
+func (smt *SparseMerkleTree) setUnfinishedSync(root []byte, unfinished bool) error {
+	roots, err := getIfExists(smt.nodes, unfinishedSyncsKey)
+	if err != nil {
+		return err
+	}
+	var kept []byte
+	for i := 0; i+len(root) <= len(roots); i += len(root) {
+		if !bytes.Equal(roots[i:i+len(root)], root) {
+			kept = append(kept, roots[i:i+len(root)]...)
+		}
+	}
+	if unfinished {
+		kept = append(kept, root...)
+	}
+	if len(kept) == 0 {
+		return deleteIfExists(smt.nodes, unfinishedSyncsKey)
+	}
+	return smt.nodes.Set(unfinishedSyncsKey, kept)
+}
+
+// checkNoUnfinishedSync returns an error if a sync has written some but not all of its chunks.
+func (smt *SparseMerkleTree) checkNoUnfinishedSync() error {
+	roots, err := getIfExists(smt.nodes, unfinishedSyncsKey)
+	if err != nil {
+		return err
+	}
+	if len(roots) > 0 {
+		return fmt.Errorf("sync towards %x is not finished", roots[:smt.st.pathSize()])
+	}
+	return nil
+}
+
+// syncLatestValues brings the values that Get reads by path, and the keys of the paths, from the
+// current root of the tree to a root it is about to be moved to.
+func (smt *SparseMerkleTree) syncLatestValues(root []byte) error {
+	return smt.Diff(smt.Root(), root, func(diff LeafDiff) error {
+		if diff.Kind != Removed {
+			return smt.values.Set(diff.Path, diff.NewValue)
+		}
+		if err := deleteIfExists(smt.values, diff.Path); err != nil {
+			return err
+		}
+		return smt.clearPreimage(diff.Path)
+	})
+}
+
+// Run fetches the pending chunks with the given number of concurrent fetches, and applies them one
+// at a time as they arrive. It stops fetching at the first error, and can be run again to resume.
+func (s *StateSync) Run(transport SyncTransport, parallelism int) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	type fetched struct {
+		chunk SyncChunk
+		err   error
+	}
+	pending := s.Pending()
+	indexes := make(chan int)
+	results := make(chan fetched)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(indexes)
+		for _, index := range pending {
+			select {
+			case indexes <- index:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				chunk, err := transport.FetchChunk(s.root, index, s.chunkBits)
+				if err == nil && chunk.Index != index {
+					err = fmt.Errorf("fetched sync chunk %d instead of %d", chunk.Index, index)
+				}
+				select {
+				case results <- fetched{chunk: chunk, err: err}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// After the first error no more chunks are fetched, but those already fetched are still applied.
+	var err error
+	for result := range results {
+		applyErr := result.err
+		if applyErr == nil {
+			applyErr = s.Apply(result.chunk)
+		}
+		if applyErr != nil && err == nil {
+			err = applyErr
+			close(stop)
+		}
+	}
+	return err
+}
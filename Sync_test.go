@@ -0,0 +1,199 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyTransport fails once it has fetched a number of chunks, and can tamper with the chunks it fetches.
+type flakyTransport struct {
+	SyncTransport
+	budget int32
+	tamper bool
+}
+
+func (ft *flakyTransport) FetchChunk(root []byte, index, chunkBits int) (SyncChunk, error) {
+	if atomic.AddInt32(&ft.budget, -1) < 0 {
+		return SyncChunk{}, errors.New("transport is down")
+	}
+	chunk, err := ft.SyncTransport.FetchChunk(root, index, chunkBits)
+	if ft.tamper && len(chunk.Leaves) > 0 {
+		chunk.Leaves[0].Value = []byte("tampered")
+	}
+	return chunk, err
+}
+
+// syncKey returns the i-th key of the trees synced by the tests.
+func syncKey(i int) []byte {
+	return uint64Bytes(uint64(i * 104729))[3:]
+}
+
+func TestStateSync(t *testing.T) {
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithReferenceCounting()} },
+		func() []Option { return []Option{WithDepth(40), WithRawKeys(), WithPreimages(NewMap())} },
+	} {
+		for _, numLeaves := range []int{0, 1, 3, 500} {
+			for _, chunkBits := range []int{0, 1, 4, 8} {
+				name := fmt.Sprintf("%d options, %d leaves, %d chunk bits", len(opts()), numLeaves, chunkBits)
+				srcNodes := NewMap()
+				src := NewSparseMerkleTree(srcNodes, NewMap(), NewSHA256Hasher(), opts()...)
+				for i := 0; i < numLeaves; i++ {
+					if _, err := src.Update(syncKey(i), []byte(fmt.Sprint("value", i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				root := src.Root()
+
+				// The sync is interrupted half way, and resumed by a new StateSync on the same MapDbs.
+				nodes, values := NewMap(), NewMap()
+				s, err := NewStateSync(NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), opts()...), root, chunkBits)
+				if err != nil {
+					t.Fatal(err)
+				}
+				budget := int32(1<<chunkBits) / 2
+				if err := s.Run(&flakyTransport{SyncTransport: LocalSyncTransport{src}, budget: budget}, 3); err == nil && chunkBits > 0 {
+					t.Fatalf("%s: interrupted sync succeeded", name)
+				}
+				dst := NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), opts()...)
+				s, err = NewStateSync(dst, root, chunkBits)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Chunks fetched before the transport went down are written as well.
+				if pending := len(s.Pending()); pending > 1<<chunkBits-int(budget) {
+					t.Fatalf("%s: %d chunks pending after %d were fetched", name, pending, budget)
+				}
+				if chunkBits > 0 {
+					if _, err := NewStateSync(NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), opts()...), root, chunkBits+1); err == nil {
+						t.Fatalf("%s: sync resumed with other chunk bits", name)
+					}
+				}
+				if err := s.Run(LocalSyncTransport{src}, 5); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+
+				if !s.Done() || !bytes.Equal(dst.Root(), root) {
+					t.Fatalf("%s: tree is not at the synced root", name)
+				}
+				for i := 0; i < numLeaves; i++ {
+					if value, err := dst.Get(syncKey(i)); err != nil || string(value) != fmt.Sprint("value", i) {
+						t.Fatalf("%s: leaf %d reads %q, %v", name, i, value, err)
+					}
+				}
+				if numLeaves > 0 {
+					sameEntries(t, name+": nodes", nodes, srcNodes)
+				}
+				if _, err := dst.Update(syncKey(numLeaves), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestStateSyncInterruptedBeforeMove(t *testing.T) {
+	srcNodes := NewMap()
+	src := NewSparseMerkleTree(srcNodes, NewMap(), NewSHA256Hasher(), WithReferenceCounting())
+	for i := 0; i < 100; i++ {
+		src.Update(syncKey(i), []byte("synced"))
+	}
+	nodes, values := NewMap(), &failingMap{Map: NewMap()}
+	dst := NewSparseMerkleTree(nodes, values, NewSHA256Hasher(), WithReferenceCounting())
+	dst.Update([]byte("gone"), []byte("local"))
+	localRoot := dst.Root()
+
+	// The value of the removed key cannot be deleted, so the sync stops before the tree is moved.
+	values.failDeletes = true
+	s, err := NewStateSync(dst, src.Root(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(LocalSyncTransport{src}, 2); !errors.Is(err, errStorage) {
+		t.Fatalf("sync returned %v", err)
+	}
+	if len(s.Pending()) != 1 {
+		t.Fatalf("%d chunks pending after the last one failed", len(s.Pending()))
+	}
+
+	// A resumed sync fetches the last chunk again, and finishes the move.
+	values.failDeletes = false
+	dst, err = ImportSparseMerkleTree(nodes, values, NewSHA256Hasher(), localRoot, WithReferenceCounting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewStateSync(dst, src.Root(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if s.Done() || !bytes.Equal(dst.Root(), localRoot) {
+		t.Fatal("interrupted sync is done")
+	}
+	if err := s.Run(LocalSyncTransport{src}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Root(), src.Root()) {
+		t.Fatal("tree is not at the synced root")
+	}
+	if value, _ := dst.Get([]byte("gone")); value != nil {
+		t.Fatalf("key that is not under the synced root reads %q", value)
+	}
+	// The local tree is released once, and the synced root is retained once.
+	sameEntries(t, "nodes", nodes, srcNodes)
+	if refCounts(nodes) != refCounts(srcNodes) {
+		t.Fatalf("%d reference counts, want %d", refCounts(nodes), refCounts(srcNodes))
+	}
+}
+
+func TestStateSyncRejectsTamperedChunks(t *testing.T) {
+	src := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 100; i++ {
+		src.Update(syncKey(i), []byte("value"))
+	}
+	nodes, values := NewMap(), NewMap()
+	s, err := NewStateSync(NewSparseMerkleTree(nodes, values, NewSHA256Hasher()), src.Root(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(&flakyTransport{SyncTransport: LocalSyncTransport{src}, budget: 100, tamper: true}, 2); err == nil {
+		t.Fatal("tampered chunks were applied")
+	}
+	if len(s.Pending()) != 4 || len(mapEntries(nodes)) != 0 || len(mapEntries(values)) != 0 {
+		t.Fatal("tampered chunks were written")
+	}
+}
+
+func TestStateSyncReplacesLatestValues(t *testing.T) {
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithOrphanRetention()} },
+		func() []Option { return []Option{WithReferenceCounting(), WithPreimages(NewMap())} },
+	} {
+		src := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), opts()...)
+		dst := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), opts()...)
+		for i := 0; i < 50; i++ {
+			src.Update(syncKey(i), []byte("synced"))
+			dst.Update(syncKey(i), []byte("local"))
+		}
+		dst.Update([]byte("gone"), []byte("local"))
+
+		s, err := NewStateSync(dst, src.Root(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Run(LocalSyncTransport{src}, 2); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := dst.Get([]byte("gone")); value != nil {
+			t.Fatalf("key that is not under the synced root reads %q", value)
+		}
+		for i := 0; i < 50; i++ {
+			if value, _ := dst.Get(syncKey(i)); string(value) != "synced" {
+				t.Fatalf("leaf %d reads %q", i, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package smt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// TreeHasher computes the hashes of a SparseMerkleTree. Every hash it returns must be Size bytes long,
+// and its methods must be safe for concurrent use, as those of the built-in hashers are.
+type TreeHasher interface {
+	Path(key []byte) []byte                 // Path hashes a key into the path of its leaf.
+	Value(value []byte) []byte              // Value hashes a value into the value hash stored in its leaf.
+	Leaf(path, valueHash []byte) []byte     // Leaf hashes a leaf from its path and value hash.
+	Node(leftHash, rightHash []byte) []byte // Node hashes an inner node from the hashes of its children.
+	Size() int                              // Size is the length of the hashes.
+	Name() string                           // Name identifies the hash function and its parameters, and is stored with the tree.
+}
+
+// NewTreeHasher creates a TreeHasher with the given name that hashes each key, value, leaf and node
+// once with a hash.Hash made by newHash. Leaves are hashed as leafPrefix|path|valueHash, and nodes as nodePrefix|left|right.
+func NewTreeHasher(name string, newHash func() hash.Hash) TreeHasher {
+	h := &digestHasher{name: name, newHash: newHash, size: newHash().Size()}
+	h.pool.New = func() interface{} {
+		return newHash()
+	}
+	return h
+}
+
+// NewSHA256Hasher creates a TreeHasher using SHA-256.
+func NewSHA256Hasher() TreeHasher {
+	return NewTreeHasher("sha256", sha256.New)
+}
+
+// NewSHA3Hasher creates a TreeHasher using SHA3-256.
+func NewSHA3Hasher() TreeHasher {
+	return NewTreeHasher("sha3-256", sha3.New256)
+}
+
+// NewKeccak256Hasher creates a TreeHasher using Keccak-256, as used by Ethereum.
+func NewKeccak256Hasher() TreeHasher {
+	return NewTreeHasher("keccak256", sha3.NewLegacyKeccak256)
+}
+
+// NewBlake2bHasher creates a TreeHasher using BLAKE2b-256.
+func NewBlake2bHasher() TreeHasher {
+	return NewTreeHasher("blake2b-256", func() hash.Hash {
+		// New256 only fails for keys longer than 64 bytes.
+		h, _ := blake2b.New256(nil)
+		return h
+	})
+}
+
+// newHasherInstance returns a TreeHasher computing the same hashes as a TreeHasher created by this
+// package and sharing no state with it, or nil if the TreeHasher was not created by this package.
+func newHasherInstance(hasher TreeHasher) TreeHasher {
+	switch h := hasher.(type) {
+	case *digestHasher:
+		return NewTreeHasher(h.name, h.newHash)
+	case PoseidonHasher:
+		// PoseidonHasher has no state.
+		return h
+	}
+	return nil
+}
+
+// builtinHasher returns the built-in TreeHasher with the given name, or nil if there is none.
+func builtinHasher(name string) TreeHasher {
+	for _, newHasher := range []func() TreeHasher{NewSHA256Hasher, NewSHA3Hasher, NewKeccak256Hasher, NewBlake2bHasher, NewPoseidonHasher} {
+		if hasher := newHasher(); hasher.Name() == name {
+			return hasher
+		}
+	}
+	return nil
+}
+
+// digestHasher is a TreeHasher built on a hash.Hash. It is safe for concurrent use, as each
+// hash is computed by a hash.Hash taken from a pool.
+type digestHasher struct {
+	name    string
+	newHash func() hash.Hash
+	size    int
+	pool    sync.Pool
+}
+
+func (h *digestHasher) Path(key []byte) []byte {
+	return h.sum(key)
+}
+
+func (h *digestHasher) Value(value []byte) []byte {
+	return h.sum(value)
+}
+
+func (h *digestHasher) Leaf(path, valueHash []byte) []byte {
+	return h.sum(leafPrefix, path, valueHash)
+}
+
+func (h *digestHasher) Node(leftHash, rightHash []byte) []byte {
+	return h.sum(nodePrefix, leftHash, rightHash)
+}
+
+func (h *digestHasher) Size() int {
+	return h.size
+}
+
+func (h *digestHasher) Name() string {
+	return h.name
+}
+
+func (h *digestHasher) sum(data ...[]byte) []byte {
+	hasher := h.pool.Get().(hash.Hash)
+	defer h.pool.Put(hasher)
+	hasher.Reset()
+	for _, d := range data {
+		hasher.Write(d)
+	}
+	return hasher.Sum(nil)
+}
+
+// hasherKey is the key under which the name of the hasher of the tree is stored in the nodes MapDb.
+var hasherKey = []byte("smt:hasher")
+
+// InvalidHasher is thrown when a tree is opened with another hasher than the one that built it.
+type InvalidHasher struct {
+	Stored string
+	Hasher string
+}
+
+func (e *InvalidHasher) Error() string {
+	return fmt.Sprintf("invalid hasher: tree was built with %q, not %q", e.Stored, e.Hasher)
+}
+
+// checkHasher checks that the tree was built with its hasher, and records the hasher if the
+// MapDb does not name one yet.
+func (smt *SparseMerkleTree) checkHasher() error {
+	// Every write checks the hasher, and fails as well if the options are invalid.
+	if smt.optionsErr != nil {
+		return smt.optionsErr
+	}
+	if smt.hasherChecked {
+		return nil
+	}
+	stored, err := getIfExists(smt.nodes, hasherKey)
+	if err != nil {
+		return err
+	}
+	name := smt.st.name()
+	if stored == nil {
+		if err := smt.nodes.Set(hasherKey, []byte(name)); err != nil {
+			return err
+		}
+	} else if string(stored) != name {
+		return &InvalidHasher{Stored: string(stored), Hasher: name}
+	}
+	smt.hasherChecked = true
+	return nil
+}
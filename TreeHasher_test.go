@@ -0,0 +1,61 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestSHA256HasherHashesOnce(t *testing.T) {
+	key, value := []byte("key"), []byte("value")
+	path, valueHash := sha256.Sum256(key), sha256.Sum256(value)
+	leaf := sha256.Sum256(append(append([]byte{0}, path[:]...), valueHash[:]...))
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	root, err := smt.Update(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, leaf[:]) {
+		t.Fatalf("root of a single leaf is %x, want %x", root, leaf)
+	}
+}
+
+func TestBuiltinHashers(t *testing.T) {
+	sha3Sum := sha3.Sum256([]byte("x"))
+	blake2bSum := blake2b.Sum256([]byte("x"))
+	keccakEmpty, _ := hex.DecodeString("c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")
+	for _, test := range []struct {
+		hasher TreeHasher
+		input  []byte
+		want   []byte
+	}{
+		{NewSHA3Hasher(), []byte("x"), sha3Sum[:]},
+		{NewBlake2bHasher(), []byte("x"), blake2bSum[:]},
+		{NewKeccak256Hasher(), nil, keccakEmpty},
+	} {
+		if got := test.hasher.Value(test.input); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.hasher.Name(), got, test.want)
+		}
+		if got := test.hasher.Path(test.input); !bytes.Equal(got, test.want) {
+			t.Errorf("%s path: got %x, want %x", test.hasher.Name(), got, test.want)
+		}
+		if builtin := builtinHasher(test.hasher.Name()); builtin == nil || builtin.Name() != test.hasher.Name() {
+			t.Errorf("%s is not a builtin hasher", test.hasher.Name())
+		}
+
+		smt := NewSparseMerkleTree(NewMap(), NewMap(), test.hasher)
+		smt.Update([]byte("a"), []byte("1"))
+		smt.Update([]byte("b"), []byte("2"))
+		proof, _ := smt.Prove([]byte("a"))
+		if !VerifyProof(proof, smt.Root(), []byte("a"), []byte("1"), test.hasher) {
+			t.Errorf("%s: proof does not verify", test.hasher.Name())
+		}
+		if VerifyProof(proof, smt.Root(), []byte("a"), []byte("1"), NewSHA256Hasher()) {
+			t.Errorf("%s: proof verifies with another hasher", test.hasher.Name())
+		}
+	}
+}
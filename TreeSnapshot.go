@@ -0,0 +1,252 @@
+package smt
+
+import (
+	"bytes"
+	"sync"
+)
+
+// TreeSnapshot is a read-only view of a SparseMerkleTree at the root it had when the snapshot was
+// taken. The nodes it reaches are not deleted by updates of the tree until it is released, and it
+// can be read from other goroutines while the tree is being updated, without locking the tree, as
+// long as the MapDbs of the tree are safe for concurrent use, as Map is.
+type TreeSnapshot struct {
+	smt     *SparseMerkleTree
+	root    []byte
+	release sync.Once
+}
+
+// snapshotPins keeps the nodes reachable from the live snapshots of a tree from being deleted.
+type snapshotPins struct {
+	// mu guards the pins, which released snapshots update from any goroutine. It does not guard
+	// the reference counts of the tree, which only its writers update.
+	mu sync.Mutex
+	// roots counts the live snapshots of each root.
+	roots map[string]int
+	// orphans are the nodes orphaned while snapshots were live, and tells whether each is a leaf.
+	// They are deleted by the first update that orphans a node once no snapshot is live.
+	orphans map[string]bool
+	// released are the roots of the released snapshots of a tree that counts references, whose
+	// references are dropped by the next move of the root.
+	released [][]byte
+
+	// With WithDeferredWrites, the references to the roots of snapshots are taken and dropped in
+	// the discarded changes, and so are the deletions of orphans.
+	// changes are the references taken and dropped since the last commit, in order.
+	changes []snapshotRefChange
+	// skipped counts for each root the releases to skip, as the reference was discarded with the
+	// nodes of the root.
+	skipped map[string]int
+	// committedOrphans are the orphans kept at the last commit.
+	committedOrphans map[string]bool
+}
+
+// snapshotRefChange is a reference to the root of a snapshot taken or dropped.
+type snapshotRefChange struct {
+	root   []byte
+	retain bool
+}
+
+// Snapshot returns a read-only view of the tree at its current root. It must be released once it
+// is not used anymore, so that the nodes it pins can be deleted. Snapshot must not be called
+// concurrently with updates of the tree, and with WithReferenceCounting it updates the tree
+// itself, as it adds a reference to the root. With WithDeferredWrites, the snapshot of a root that is
+// not committed cannot be read anymore once the changes are discarded.
+func (smt *SparseMerkleTree) Snapshot() (*TreeSnapshot, error) {
+	root := smt.Root()
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	if smt.refCounted {
+		// The snapshot holds a reference to its root.
+		if err := smt.retain(root); err != nil {
+			return nil, err
+		}
+		if smt.deferredWrites {
+			pins.changes = append(pins.changes, snapshotRefChange{root: root, retain: true})
+		}
+	}
+	if pins.roots == nil {
+		pins.roots = make(map[string]int)
+	}
+	pins.roots[string(root)]++
+	return &TreeSnapshot{smt: smt, root: root}, nil
+}
+
+// Root returns the root of the snapshot.
+func (s *TreeSnapshot) Root() []byte {
+	return s.root
+}
+
+// Get gets the value of a key.
+func (s *TreeSnapshot) Get(key []byte) ([]byte, error) {
+	return s.smt.GetAt(key, s.root)
+}
+
+// Check returns true if the value of a key is non-default, and false otherwise.
+func (s *TreeSnapshot) Check(key []byte) (bool, error) {
+	return s.smt.CheckAt(key, s.root)
+}
+
+// Prove generates a Merkle proof for a key against the root of the snapshot.
+func (s *TreeSnapshot) Prove(key []byte) (SparseMerkleProof, error) {
+	return s.smt.ProveAt(key, s.root)
+}
+
+// Iterate calls fn for the leaves of the snapshot in path order, as SparseMerkleTree.Iterate does.
+func (s *TreeSnapshot) Iterate(fromPath []byte, fn func(path, key, valueHash, value []byte) error) error {
+	return s.smt.Iterate(s.root, fromPath, fn)
+}
+
+// Release unpins the nodes of the snapshot, which must not be used anymore. It can be called from
+// any goroutine, and more than once. The nodes are deleted by the next updates of the tree.
+func (s *TreeSnapshot) Release() {
+	s.release.Do(func() {
+		pins := &s.smt.pins
+		pins.mu.Lock()
+		defer pins.mu.Unlock()
+		if pins.roots[string(s.root)]--; pins.roots[string(s.root)] == 0 {
+			delete(pins.roots, string(s.root))
+		}
+		if s.smt.refCounted && !pins.skip(s.root) {
+			pins.released = append(pins.released, s.root)
+		}
+	})
+}
+
+// pinnedRoots returns the roots of the live snapshots of the tree.
+func (smt *SparseMerkleTree) pinnedRoots() [][]byte {
+	smt.pins.mu.Lock()
+	defer smt.pins.mu.Unlock()
+	var roots [][]byte
+	for root := range smt.pins.roots {
+		roots = append(roots, []byte(root))
+	}
+	return roots
+}
+
+// pinOrphan keeps an orphaned node until no snapshot is live, and tells whether it did. Once no
+// snapshot is live, the nodes kept so far are deleted.
+func (smt *SparseMerkleTree) pinOrphan(nodeHash []byte, isLeaf bool) (bool, error) {
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	if len(pins.roots) > 0 {
+		if pins.orphans == nil {
+			pins.orphans = make(map[string]bool)
+		}
+		pins.orphans[string(nodeHash)] = isLeaf
+		return true, nil
+	}
+
+	for orphan, isLeaf := range pins.orphans {
+		if err := deleteIfExists(smt.nodes, []byte(orphan)); err != nil {
+			return false, err
+		}
+		if isLeaf {
+			if err := deleteIfExists(smt.values, []byte(orphan)); err != nil {
+				return false, err
+			}
+		}
+		delete(pins.orphans, orphan)
+	}
+	return false, nil
+}
+
+// unpinOrphan forgets an orphaned node kept for snapshots, as an update stores it again.
+func (smt *SparseMerkleTree) unpinOrphan(nodeHash []byte) {
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	delete(pins.orphans, string(nodeHash))
+}
+
+// releaseSnapshots drops the references held by the released snapshots of a tree that counts references.
+func (smt *SparseMerkleTree) releaseSnapshots() error {
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	for len(pins.released) > 0 {
+		if err := smt.release(pins.released[0]); err != nil {
+			return err
+		}
+		if smt.deferredWrites {
+			pins.changes = append(pins.changes, snapshotRefChange{root: pins.released[0]})
+		}
+		pins.released = pins.released[1:]
+	}
+	return nil
+}
+
+// skip tells whether the release of a root must be skipped, and counts it as skipped.
+func (pins *snapshotPins) skip(root []byte) bool {
+	if pins.skipped[string(root)] == 0 {
+		return false
+	}
+	if pins.skipped[string(root)]--; pins.skipped[string(root)] == 0 {
+		delete(pins.skipped, string(root))
+	}
+	return true
+}
+
+// commitPins records the orphans kept at a commit, and forgets the references changed before.
+func (smt *SparseMerkleTree) commitPins() {
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	pins.changes = nil
+	pins.committedOrphans = copyOrphans(pins.orphans)
+}
+
+// discardPins brings the snapshot pins of a tree in line with the MapDbs once the changes since the
+// last commit are discarded. The orphans kept then are kept again, and the references to the roots
+// of snapshots are taken and dropped again, but for the roots whose nodes were discarded.
+func (smt *SparseMerkleTree) discardPins() error {
+	pins := &smt.pins
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	pins.orphans = copyOrphans(pins.committedOrphans)
+
+	changes, released := pins.changes, pins.released
+	pins.changes, pins.released = nil, nil
+	for _, change := range changes {
+		if !change.retain {
+			// The dropped reference is dropped again by the next move of the root.
+			if !pins.skip(change.root) {
+				pins.released = append(pins.released, change.root)
+			}
+			continue
+		}
+		rootData, err := getIfExists(smt.nodes, change.root)
+		if err != nil {
+			return err
+		}
+		if rootData == nil && !bytes.Equal(change.root, smt.st.EmptyPlace()) {
+			if pins.skipped == nil {
+				pins.skipped = make(map[string]int)
+			}
+			pins.skipped[string(change.root)]++
+			continue
+		}
+		if err := smt.retain(change.root); err != nil {
+			return err
+		}
+		pins.changes = append(pins.changes, change)
+	}
+	for _, root := range released {
+		if !pins.skip(root) {
+			pins.released = append(pins.released, root)
+		}
+	}
+	return nil
+}
+
+func copyOrphans(orphans map[string]bool) map[string]bool {
+	if len(orphans) == 0 {
+		return nil
+	}
+	copied := make(map[string]bool, len(orphans))
+	for orphan, isLeaf := range orphans {
+		copied[orphan] = isLeaf
+	}
+	return copied
+}
@@ -0,0 +1,225 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTreeSnapshots(t *testing.T) {
+	for _, opts := range []func() []Option{
+		func() []Option { return nil },
+		func() []Option { return []Option{WithReferenceCounting()} },
+		func() []Option { return []Option{WithDeferredWrites()} },
+		func() []Option { return []Option{WithPreimages(NewMap())} },
+	} {
+		name := fmt.Sprintf("%d options", len(opts()))
+		nodes := NewMap()
+		c := NewConcurrentSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher(), opts()...)
+		model := make(map[string]string)
+		for i := 0; i < 40; i++ {
+			key, value := fmt.Sprint("key", i), fmt.Sprint("value", i)
+			c.Update([]byte(key), []byte(value))
+			model[key] = value
+		}
+		c.Commit()
+
+		// Snapshots are read by other goroutines while the tree is updated.
+		type snapshot struct {
+			*TreeSnapshot
+			model map[string]string
+		}
+		snapshots := make(chan snapshot, 64)
+		errs := make(chan error, 4)
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for s := range snapshots {
+					if err := checkTreeSnapshot(s.TreeSnapshot, s.model); err != nil {
+						errs <- err
+						return
+					}
+					s.Release()
+					s.Release()
+				}
+			}()
+		}
+		for i := 0; i < 150; i++ {
+			if i%3 == 0 {
+				s, err := c.Snapshot()
+				if err != nil {
+					t.Fatal(err)
+				}
+				snapshotModel := make(map[string]string, len(model))
+				for key, value := range model {
+					snapshotModel[key] = value
+				}
+				snapshots <- snapshot{s, snapshotModel}
+			}
+			key := fmt.Sprint("key", i*13%60)
+			if i%4 == 3 {
+				c.Delete([]byte(key))
+				delete(model, key)
+			} else {
+				c.Update([]byte(key), []byte(fmt.Sprint("value", i)))
+				model[key] = fmt.Sprint("value", i)
+			}
+			if i%10 == 9 {
+				c.Commit()
+			}
+		}
+		close(snapshots)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// Once the snapshots are released, the next updates delete the nodes they pinned.
+		c.Update([]byte("key0"), []byte("value"))
+		c.Update([]byte("key0"), []byte("last value"))
+		model["key0"] = "last value"
+		c.Commit()
+		freshNodes := NewMap()
+		fresh := NewSparseMerkleTree(freshNodes, NewMap(), NewSHA256Hasher(), opts()...)
+		for key, value := range model {
+			fresh.Update([]byte(key), []byte(value))
+		}
+		fresh.Commit()
+		if !bytes.Equal(fresh.Root(), c.Root()) {
+			t.Fatalf("%s: root differs from a fresh tree", name)
+		}
+		sameEntries(t, name+": nodes", nodes, freshNodes)
+	}
+}
+
+// checkTreeSnapshot returns an error if a snapshot does not hold the content of a model.
+func checkTreeSnapshot(s *TreeSnapshot, model map[string]string) error {
+	for i := 0; i < 60; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if string(value) != model[string(key)] {
+			return fmt.Errorf("snapshot reads %q for %s, want %q", value, key, model[string(key)])
+		}
+		if i%7 == 0 {
+			proof, err := s.Prove(key)
+			if err != nil {
+				return err
+			}
+			if !VerifyProof(proof, s.Root(), key, value, NewSHA256Hasher()) {
+				return fmt.Errorf("proof of %s does not verify", key)
+			}
+		}
+	}
+	numLeaves := 0
+	if err := s.Iterate(nil, func(_, _, _, _ []byte) error {
+		numLeaves++
+		return nil
+	}); err != nil {
+		return err
+	}
+	if numLeaves != len(model) {
+		return fmt.Errorf("snapshot has %d leaves, want %d", numLeaves, len(model))
+	}
+	return nil
+}
+
+func TestTreeSnapshotsAcrossDiscard(t *testing.T) {
+	for _, opts := range [][]Option{{WithDeferredWrites()}, {WithDeferredWrites(), WithReferenceCounting()}} {
+		name := fmt.Sprintf("%d options", len(opts))
+		nodes := NewMap()
+		smt := NewSparseMerkleTree(nodes, NewMap(), NewSHA256Hasher(), opts...)
+		for i := 0; i < 20; i++ {
+			smt.Update([]byte(fmt.Sprint("key", i)), []byte("value"))
+		}
+		smt.Commit()
+
+		// The snapshot is taken and released around changes that are discarded.
+		s, err := smt.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smt.Update([]byte("key0"), []byte("discarded"))
+		// A snapshot of a root that is never committed.
+		discarded, err := smt.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := smt.Discard(); err != nil {
+			t.Fatal(err)
+		}
+		s.Release()
+		discarded.Release()
+		for i := 0; i < 3; i++ {
+			if _, err := smt.Update([]byte("key1"), []byte(fmt.Sprint("value", i))); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if err := smt.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A snapshot taken before the last commit and released since is released again.
+		s, err = smt.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smt.Commit()
+		s.Release()
+		smt.Update([]byte("key2"), []byte("discarded"))
+		if err := smt.Discard(); err != nil {
+			t.Fatal(err)
+		}
+		smt.Update([]byte("key2"), []byte("value2"))
+		smt.Update([]byte("key2"), []byte("value"))
+		smt.Commit()
+
+		for i := 0; i < 20; i++ {
+			want := "value"
+			if i == 1 {
+				want = "value2"
+			}
+			if value, err := smt.Get([]byte(fmt.Sprint("key", i))); err != nil || string(value) != want {
+				t.Fatalf("%s: key%d reads %q, %v", name, i, value, err)
+			}
+		}
+		freshNodes := NewMap()
+		fresh := NewSparseMerkleTree(freshNodes, NewMap(), NewSHA256Hasher(), opts...)
+		for i := 0; i < 20; i++ {
+			fresh.Update([]byte(fmt.Sprint("key", i)), []byte("value"))
+		}
+		fresh.Update([]byte("key1"), []byte("value2"))
+		fresh.Commit()
+		sameEntries(t, name+": nodes", nodes, freshNodes)
+		if smt.refCounted {
+			sameMaps(t, name+": nodes and counts", nodes, freshNodes)
+		}
+	}
+}
+
+func TestTreeSnapshotsAndPrune(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher(), WithOrphanRetention())
+	smt.Update([]byte("key1"), []byte("value1"))
+	smt.Update([]byte("key2"), []byte("value2"))
+	s, err := smt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smt.Update([]byte("key1"), []byte("value3"))
+	if _, err := smt.Prune([][]byte{smt.Root()}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Get([]byte("key1")); err != nil || string(value) != "value1" {
+		t.Fatalf("snapshot reads %q, %v after a prune", value, err)
+	}
+	s.Release()
+	if result, _ := smt.Prune([][]byte{smt.Root()}); result.Nodes == 0 {
+		t.Fatal("nodes of a released snapshot were not pruned")
+	}
+}
@@ -0,0 +1,77 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// UpdateRootWithProof computes the root that results from setting a key to newValue in the tree with the given root,
+// without access to the tree's MapDbs. The proof must be a valid proof that the key currently holds oldValue,
+// where a DefaultVal oldValue means that the key is not present.
+// The options must be those of the tree.
+func UpdateRootWithProof(proof SparseMerkleProof, root, key, oldValue, newValue []byte, hasher TreeHasher, opts ...Option) ([]byte, error) {
+	if !VerifyProof(proof, root, key, oldValue, hasher, opts...) {
+		return nil, errors.New("invalid proof")
+	}
+
+	st, err := proofHasher(hasher, opts)
+	if err != nil {
+		return nil, err
+	}
+	path, err := st.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(newValue, DefaultVal) {
+		return deleteRootWithProof(st, proof, root, path, oldValue)
+	}
+
+	// Determine the leaf currently found at the position of the key, as sideNodesForRoot would.
+	valueHash := st.digest(newValue)
+	oldLeafHash, oldLeafData := st.EmptyPlace(), proof.NonMembershipLeafData
+	if !bytes.Equal(oldValue, DefaultVal) {
+		oldValueHash := st.digest(oldValue)
+		if bytes.Equal(oldValueHash, valueHash) {
+			// Short-circuit if the same value is being set
+			return root, nil
+		}
+		oldLeafHash, oldLeafData = st.digestLeaf(path, oldValueHash)
+	} else if oldLeafData != nil {
+		oldLeafHash, _ = st.digestLeaf(st.parseLeaf(oldLeafData))
+	}
+
+	return updateWithSideNodes(st, st.depth, path, valueHash, oldLeafHash, oldLeafData, proof.SideNodes, discardNode)
+}
+
+// DeleteRootWithProof computes the root that results from deleting a key from the tree with the given root,
+// without access to the tree's MapDbs. The proof must be a valid proof that the key currently holds oldValue,
+// and must include the sibling data.
+func DeleteRootWithProof(proof SparseMerkleProof, root, key, oldValue []byte, hasher TreeHasher, opts ...Option) ([]byte, error) {
+	return UpdateRootWithProof(proof, root, key, oldValue, DefaultVal, hasher, opts...)
+}
+
+// deleteRootWithProof computes the root after removing the leaf of a path from a verified proof.
+func deleteRootWithProof(st *SmtHasher, proof SparseMerkleProof, root, path, oldValue []byte) ([]byte, error) {
+	if bytes.Equal(oldValue, DefaultVal) {
+		// This key is already empty; return the old root.
+		return root, nil
+	}
+
+	// The leaf-bubbling logic of DeleteNode needs to know whether the sibling
+	// of the deleted leaf is itself a leaf.
+	siblingIsLeaf := false
+	if len(proof.SideNodes) > 0 {
+		if len(proof.SiblingData) == 0 {
+			return nil, errors.New("proof has no sibling data")
+		}
+		siblingIsLeaf = st.isLeaf(proof.SiblingData)
+	}
+
+	return deleteWithSideNodes(st, path, proof.SideNodes, siblingIsLeaf, discardNode)
+}
+
+// discardNode is a node setter for root computations that do not store their nodes.
+func discardNode(hash, data []byte) error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestUpdateRootWithProof(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	model := make(map[string][]byte)
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprint("key", rng.Intn(150)))
+		oldValue := model[string(key)]
+		var newValue []byte
+		switch rng.Intn(4) {
+		case 0:
+			newValue = DefaultVal
+		case 1:
+			newValue = oldValue
+		default:
+			newValue = []byte(fmt.Sprint("value", i))
+		}
+
+		proof, err := smt.Prove(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := UpdateRootWithProof(proof, smt.Root(), key, oldValue, newValue, NewSHA256Hasher())
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if _, err := smt.Update(key, newValue); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, smt.Root()) {
+			t.Fatalf("step %d: root from proof %x, tree root %x", i, root, smt.Root())
+		}
+		if len(newValue) == 0 {
+			delete(model, string(key))
+		} else {
+			model[string(key)] = newValue
+		}
+	}
+}
+
+func TestDeleteRootWithProof(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	for i := 0; i < 100; i++ {
+		smt.Update([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	for i := 0; i < 120; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := DefaultVal
+		if i < 100 {
+			value = []byte(fmt.Sprint("value", i))
+		}
+		proof, _ := smt.Prove(key)
+		root, err := DeleteRootWithProof(proof, smt.Root(), key, value, NewSHA256Hasher())
+		if err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		smt.Delete(key)
+		if !bytes.Equal(root, smt.Root()) {
+			t.Fatalf("delete %s: root from proof %x, tree root %x", key, root, smt.Root())
+		}
+	}
+	if !bytes.Equal(smt.Root(), smt.st.EmptyPlace()) {
+		t.Fatal("tree is not empty")
+	}
+}
+
+func TestUpdateRootWithProofRejectsWrongOldValue(t *testing.T) {
+	smt := NewSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	smt.Update([]byte("key"), []byte("value"))
+	smt.Update([]byte("other"), []byte("value"))
+	proof, _ := smt.Prove([]byte("key"))
+	if _, err := UpdateRootWithProof(proof, smt.Root(), []byte("key"), []byte("wrong"), []byte("new"), NewSHA256Hasher()); err == nil {
+		t.Error("update with a wrong old value succeeded")
+	}
+	if _, err := DeleteRootWithProof(proof, smt.Root(), []byte("key"), DefaultVal, NewSHA256Hasher()); err == nil {
+		t.Error("delete with a wrong old value succeeded")
+	}
+}
@@ -1,12 +1,5 @@
 package smt
 
-import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
-	"log"
-)
-
 // getBitFromMSB gets the bit at an offset from the most significant bit
 func getBitFromMSB(data []byte, position int) int {
 	if int(data[position/8])&(1<<(8-1-uint(position)%8)) > 0 {
@@ -33,10 +26,10 @@ func countSetBits(data []byte) int {
 	return count
 }
 
-//countCommonPrefix counts the number of common prefix
-func countCommonPrefix(data1 []byte, data2 []byte) int {
+//countCommonPrefix counts the number of common prefix bits, up to the given number of bits
+func countCommonPrefix(data1 []byte, data2 []byte, bits int) int {
 	count := 0
-	for i := 0; i < len(data1)*8; i++ {
+	for i := 0; i < bits; i++ {
 		if getBitFromMSB(data1, i) == getBitFromMSB(data2, i) {
 			count++
 		} else {
@@ -60,29 +53,3 @@ func reverseByteSlices(slices [][]byte) [][]byte {
 
 	return slices
 }
-
-//GobEncode encodes the given data
-func GobEncode(node SparseMerkleNode) []byte {
-	var network bytes.Buffer        // Stand-in for a network connection
-	enc := gob.NewEncoder(&network) // Will write to network.
-	err := enc.Encode(node)
-	if err != nil {
-		log.Fatal("encode error:", err)
-	}
-
-	return network.Bytes()
-}
-
-//GobDecode decodes the bytes into data
-func GobDecode(data []byte, node *SparseMerkleNode) *SparseMerkleNode {
-	//Declare a new reader from the data and a new gob Decoder
-	reader := bytes.NewReader(data)
-	decoder := gob.NewDecoder(reader)
-	println(decoder)
-	//Decode the data into object
-	if err := decoder.Decode(&node); err != nil {
-		log.Fatal("decode error:", err)
-	}
-	fmt.Println(node)
-	return node
-}
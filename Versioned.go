@@ -0,0 +1,357 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Keys under which the versioned tree stores its metadata in the nodes MapDb.
+// All of them start with metaKeyPrefix, so that Prune can tell them apart from nodes.
+var (
+	metaKeyPrefix    = []byte("smt:")
+	workingRootKey   = []byte("smt:root")
+	latestVersionKey = []byte("smt:latest")
+	versionsKey      = []byte("smt:versions")
+	versionKeyPrefix = []byte("smt:version:")
+)
+
+// InvalidVersion is thrown when a version that does not exist is being accessed.
+type InvalidVersion struct {
+	Version uint64
+}
+
+func (e *InvalidVersion) Error() string {
+	return fmt.Sprintf("invalid version: %d", e.Version)
+}
+
+// VersionedSparseMerkleTree is a SparseMerkleTree that keeps the roots of its committed versions.
+// The nodes of a version stay in the MapDb until the version is deleted or rolled back.
+// Nodes orphaned between two commits belong to no version, and are kept until Prune is called
+// with the RetainedRoots, unless the tree counts references (see WithReferenceCounting).
+type VersionedSparseMerkleTree struct {
+	*SparseMerkleTree
+	latest   uint64
+	versions []uint64
+}
+
+// NewVersionedSparseMerkleTree creates a versioned Sparse Merkle tree on the given MapDbs.
+// If the MapDbs already hold a versioned tree, it is reopened at the root it had when it was last updated,
+// and an InvalidHasher error is returned if it was built with another hasher.
+func NewVersionedSparseMerkleTree(nodes, values MapDb, hasher TreeHasher, opts ...Option) (*VersionedSparseMerkleTree, error) {
+	vt := VersionedSparseMerkleTree{SparseMerkleTree: NewSparseMerkleTree(nodes, values, hasher, opts...)}
+	if !vt.refCounted {
+		// Without reference counts, the nodes of past versions are kept by not deleting orphans.
+		vt.keepOrphans = true
+	}
+
+	if err := vt.checkHasher(); err != nil {
+		return nil, err
+	}
+	if err := vt.loadVersions(); err != nil {
+		return nil, err
+	}
+	return &vt, nil
+}
+
+// loadVersions reads the versions and the working root stored in the nodes MapDb.
+func (vt *VersionedSparseMerkleTree) loadVersions() error {
+	vt.latest = 0
+	latest, err := getIfExists(vt.nodes, latestVersionKey)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		vt.latest = binary.BigEndian.Uint64(latest)
+	}
+	versions, err := getIfExists(vt.nodes, versionsKey)
+	if err != nil {
+		return err
+	}
+	vt.versions = nil
+	for i := 0; i+8 <= len(versions); i += 8 {
+		vt.versions = append(vt.versions, binary.BigEndian.Uint64(versions[i:]))
+	}
+
+	root, err := getIfExists(vt.nodes, workingRootKey)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		vt.SetRoot(root)
+		vt.committedRoot = root
+	}
+	return nil
+}
+
+// Update sets a new value for a key in the tree, and sets and returns the new root of the tree.
+// The new root is stored, so that the tree can be reopened at it.
+func (vt *VersionedSparseMerkleTree) Update(key, value []byte) ([]byte, error) {
+	newRoot, err := vt.SparseMerkleTree.Update(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if err := vt.nodes.Set(workingRootKey, newRoot); err != nil {
+		return nil, err
+	}
+	return newRoot, nil
+}
+
+// Delete deletes a value from tree. It returns the new root of the tree.
+func (vt *VersionedSparseMerkleTree) Delete(key []byte) ([]byte, error) {
+	return vt.Update(key, DefaultVal)
+}
+
+// UpdateBatch sets new values for a set of keys in the tree, and sets and returns the new root of the tree.
+// The new root is stored, so that the tree can be reopened at it.
+func (vt *VersionedSparseMerkleTree) UpdateBatch(keys, values [][]byte) ([]byte, error) {
+	newRoot, err := vt.SparseMerkleTree.UpdateBatch(keys, values)
+	if err != nil {
+		return nil, err
+	}
+	if err := vt.nodes.Set(workingRootKey, newRoot); err != nil {
+		return nil, err
+	}
+	return newRoot, nil
+}
+
+// Get gets the value of a key from the tree.
+// Values are read from the nodes, as the latest value of a path may belong to a rolled back version.
+func (vt *VersionedSparseMerkleTree) Get(key []byte) ([]byte, error) {
+	return vt.GetAt(key, vt.Root())
+}
+
+// Check returns true if the value at given key is non-default, and false otherwise.
+func (vt *VersionedSparseMerkleTree) Check(key []byte) (bool, error) {
+	return vt.CheckAt(key, vt.Root())
+}
+
+// Commit stores the current root as a new version, and returns the version number.
+// With WithDeferredWrites, the changes made since the last commit are written as well.
+func (vt *VersionedSparseMerkleTree) Commit() (uint64, error) {
+	version := vt.latest + 1
+	if err := vt.nodes.Set(versionKey(version), vt.Root()); err != nil {
+		return 0, err
+	}
+	if vt.refCounted {
+		// Each version holds a reference to its root.
+		if err := vt.retain(vt.Root()); err != nil {
+			return 0, err
+		}
+	}
+	if err := vt.setVersions(append(vt.versions, version), version); err != nil {
+		return 0, err
+	}
+	if err := vt.SparseMerkleTree.Commit(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Discard throws away the changes made since the last commit, including the versions deleted or
+// rolled back since then. Without WithDeferredWrites, changes are already written and Discard does nothing.
+func (vt *VersionedSparseMerkleTree) Discard() error {
+	if !vt.deferredWrites {
+		return nil
+	}
+	if err := vt.SparseMerkleTree.Discard(); err != nil {
+		return err
+	}
+	return vt.loadVersions()
+}
+
+// Versions returns the committed versions that are retained, in increasing order.
+func (vt *VersionedSparseMerkleTree) Versions() []uint64 {
+	versions := make([]uint64, len(vt.versions))
+	copy(versions, vt.versions)
+	return versions
+}
+
+// RootAt gets the root of a committed version.
+func (vt *VersionedSparseMerkleTree) RootAt(version uint64) ([]byte, error) {
+	if !vt.hasVersion(version) {
+		return nil, &InvalidVersion{Version: version}
+	}
+	return vt.nodes.Get(versionKey(version))
+}
+
+// Rollback resets the tree to a committed version. Later versions and uncommitted changes are
+// discarded, and their nodes are removed from the MapDb. The numbers of the later versions are
+// not issued again.
+func (vt *VersionedSparseMerkleTree) Rollback(version uint64) error {
+	root, err := vt.RootAt(version)
+	if err != nil {
+		return err
+	}
+
+	released := [][]byte{vt.Root()}
+	split := sort.Search(len(vt.versions), func(i int) bool {
+		return vt.versions[i] > version
+	})
+	for _, v := range vt.versions[split:] {
+		laterRoot, err := vt.RootAt(v)
+		if err != nil {
+			return err
+		}
+		released = append(released, laterRoot)
+	}
+
+	retained := append([]uint64{}, vt.versions[:split]...)
+	for _, v := range vt.versions[split:] {
+		if err := vt.nodes.Delete(versionKey(v)); err != nil {
+			return err
+		}
+	}
+	if err := vt.setVersions(retained, vt.latest); err != nil {
+		return err
+	}
+	if vt.refCounted {
+		// The tree now holds a reference to the root of the version instead of its current root.
+		if err := vt.retain(root); err != nil {
+			return err
+		}
+	}
+	if err := vt.nodes.Set(workingRootKey, root); err != nil {
+		return err
+	}
+	vt.SetRoot(root)
+
+	return vt.releaseRoots(released)
+}
+
+// DeleteVersion deletes a committed version. Its nodes are removed from the MapDb, except for
+// those that are still reachable from another version or from the current root.
+func (vt *VersionedSparseMerkleTree) DeleteVersion(version uint64) error {
+	root, err := vt.RootAt(version)
+	if err != nil {
+		return err
+	}
+
+	var retained []uint64
+	for _, v := range vt.versions {
+		if v != version {
+			retained = append(retained, v)
+		}
+	}
+	if err := vt.nodes.Delete(versionKey(version)); err != nil {
+		return err
+	}
+	if err := vt.setVersions(retained, vt.latest); err != nil {
+		return err
+	}
+
+	return vt.releaseRoots([][]byte{root})
+}
+
+// releaseRoots removes the nodes reachable from the released roots that are not reachable from
+// any retained version or from the current root.
+func (vt *VersionedSparseMerkleTree) releaseRoots(released [][]byte) error {
+	if vt.refCounted {
+		// Each released root held one reference.
+		for _, root := range released {
+			if err := vt.release(root); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	retained, err := vt.RetainedRoots()
+	if err != nil {
+		return err
+	}
+	marked := make(map[string]bool)
+	for _, root := range retained {
+		if err := vt.markReachable(root, marked); err != nil {
+			return err
+		}
+	}
+
+	for _, root := range released {
+		if err := vt.sweepUnmarked(root, marked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetainedRoots returns the roots of the retained versions, of the live snapshots and the current
+// root, which are the roots to pass to Prune.
+func (vt *VersionedSparseMerkleTree) RetainedRoots() ([][]byte, error) {
+	roots := append([][]byte{vt.Root()}, vt.pinnedRoots()...)
+	for _, v := range vt.versions {
+		root, err := vt.RootAt(v)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// sweepUnmarked removes every node reachable from a root that is not marked, together with the
+// values of its leaves. Subtrees whose root is marked are left in place.
+func (smt *SparseMerkleTree) sweepUnmarked(root []byte, marked map[string]bool) error {
+	if bytes.Equal(root, smt.st.EmptyPlace()) || marked[string(root)] {
+		return nil
+	}
+	data, err := smt.nodes.Get(root)
+	if err != nil {
+		return err
+	}
+	// Mark the node so that it is only removed once if several released roots share it.
+	marked[string(root)] = true
+
+	if smt.st.isLeaf(data) {
+		if err := smt.nodes.Delete(root); err != nil {
+			return err
+		}
+		return deleteIfExists(smt.values, root)
+	}
+
+	leftNode, rightNode := smt.st.parseNode(data)
+	if err := smt.sweepUnmarked(leftNode, marked); err != nil {
+		return err
+	}
+	if err := smt.sweepUnmarked(rightNode, marked); err != nil {
+		return err
+	}
+	return smt.nodes.Delete(root)
+}
+
+func (vt *VersionedSparseMerkleTree) hasVersion(version uint64) bool {
+	i := sort.Search(len(vt.versions), func(i int) bool {
+		return vt.versions[i] >= version
+	})
+	return i < len(vt.versions) && vt.versions[i] == version
+}
+
+// setVersions stores the list of retained versions and the latest version number.
+func (vt *VersionedSparseMerkleTree) setVersions(versions []uint64, latest uint64) error {
+	data := make([]byte, len(versions)*8)
+	for i, v := range versions {
+		binary.BigEndian.PutUint64(data[i*8:], v)
+	}
+	if err := vt.nodes.Set(versionsKey, data); err != nil {
+		return err
+	}
+	if err := vt.nodes.Set(latestVersionKey, uint64Bytes(latest)); err != nil {
+		return err
+	}
+	vt.versions = versions
+	vt.latest = latest
+	return nil
+}
+
+// versionKey returns the key under which the root of a version is stored.
+func versionKey(version uint64) []byte {
+	return append(append([]byte{}, versionKeyPrefix...), uint64Bytes(version)...)
+}
+
+// uint64Bytes encodes an integer as 8 big-endian bytes.
+func uint64Bytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
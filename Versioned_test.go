@@ -0,0 +1,154 @@
+package smt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// versionedWorkload applies random updates to an empty versioned tree over keys key0 to key<numKeys-1>,
+// commits after every round, and returns the content of each version.
+func versionedWorkload(t *testing.T, vt *VersionedSparseMerkleTree, rng *rand.Rand, rounds, updates, numKeys int) map[uint64]map[string]string {
+	t.Helper()
+	models := make(map[uint64]map[string]string)
+	model := make(map[string]string)
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < updates; i++ {
+			key := fmt.Sprint("key", rng.Intn(numKeys))
+			if rng.Intn(3) == 0 {
+				if _, err := vt.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, key)
+			} else {
+				value := fmt.Sprint("value", rng.Intn(4))
+				if _, err := vt.Update([]byte(key), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				model[key] = value
+			}
+		}
+		version, err := vt.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := make(map[string]string, len(model))
+		for k, v := range model {
+			snapshot[k] = v
+		}
+		models[version] = snapshot
+	}
+	return models
+}
+
+// checkVersions fails the test if a retained version of the tree does not hold its content.
+func checkVersions(t *testing.T, vt *VersionedSparseMerkleTree, models map[uint64]map[string]string, numKeys int) {
+	t.Helper()
+	for _, version := range vt.Versions() {
+		root, err := vt.RootAt(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < numKeys; j++ {
+			key := fmt.Sprint("key", j)
+			value, err := vt.GetAt([]byte(key), root)
+			if err != nil {
+				t.Fatalf("version %d, %s: %v", version, key, err)
+			}
+			if string(value) != models[version][key] {
+				t.Fatalf("version %d, %s: got %q, want %q", version, key, value, models[version][key])
+			}
+		}
+	}
+}
+
+func TestVersionedTree(t *testing.T) {
+	nodes, values := NewMap(), NewMap()
+	vt, err := NewVersionedSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := versionedWorkload(t, vt, rand.New(rand.NewSource(7)), 20, 30, 40)
+	if versions := vt.Versions(); len(versions) != 20 || versions[0] != 1 || versions[19] != 20 {
+		t.Fatalf("versions %v", versions)
+	}
+	checkVersions(t, vt, models, 40)
+
+	for _, version := range []uint64{3, 1, 2, 10, 7} {
+		if err := vt.DeleteVersion(version); err != nil {
+			t.Fatal(err)
+		}
+		checkVersions(t, vt, models, 40)
+	}
+	var invalidVersion *InvalidVersion
+	if _, err := vt.RootAt(3); !errors.As(err, &invalidVersion) {
+		t.Fatalf("RootAt of a deleted version returned %v", err)
+	}
+
+	// Rolling back drops the later versions and the uncommitted changes.
+	vt.Update([]byte("uncommitted"), []byte("value"))
+	if err := vt.Rollback(15); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, vt, models, 40)
+	if versions := vt.Versions(); versions[len(versions)-1] != 15 {
+		t.Fatalf("versions after rollback %v", versions)
+	}
+	for j := 0; j < 40; j++ {
+		key := fmt.Sprint("key", j)
+		if value, _ := vt.Get([]byte(key)); string(value) != models[15][key] {
+			t.Fatalf("%s after rollback: got %q, want %q", key, value, models[15][key])
+		}
+	}
+	if present, _ := vt.Check([]byte("uncommitted")); present {
+		t.Fatal("uncommitted change survived the rollback")
+	}
+
+	// A reopened tree has the same versions and root, and numbers versions after the latest one
+	// issued, including the versions rolled back.
+	reopened, err := NewVersionedSparseMerkleTree(nodes, values, NewSHA256Hasher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reopened.Root()) != string(vt.Root()) || fmt.Sprint(reopened.Versions()) != fmt.Sprint(vt.Versions()) {
+		t.Fatal("reopened tree differs")
+	}
+	checkVersions(t, reopened, models, 40)
+	if version, err := reopened.Commit(); err != nil || version != 21 {
+		t.Fatalf("next version %d, %v", version, err)
+	}
+}
+
+func TestVersionNumbersAreNotReused(t *testing.T) {
+	vt, err := NewVersionedSparseMerkleTree(NewMap(), NewMap(), NewSHA256Hasher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make(map[uint64][]byte)
+	for i := 0; i < 5; i++ {
+		vt.Update([]byte("key"), []byte(fmt.Sprint("value", i)))
+		version, err := vt.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots[version] = vt.Root()
+	}
+	if err := vt.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+	vt.Update([]byte("key"), []byte("after rollback"))
+	version, err := vt.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 6 {
+		t.Fatalf("commit after a rollback issued version %d, want 6", version)
+	}
+	if _, err := vt.RootAt(3); err == nil {
+		t.Fatal("rolled back version 3 still has a root")
+	}
+	if root, _ := vt.RootAt(2); string(root) != string(roots[2]) {
+		t.Fatal("root of version 2 changed")
+	}
+}